@@ -4,14 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/gavinsh/gate/spdy"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -19,12 +23,28 @@ var end chan bool
 var quiet bool
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "proxy" {
+		proxy(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gateway" {
+		gateway(os.Args[2:])
+		return
+	}
+
 	rawurl := flag.String("u", "", "Raw url")
-	data := flag.String("d", "", "POST data")
+	data := flag.String("d", "", "POST data, @file or @- to read it from a file or stdin")
 	times := flag.Int("t", 1, "Request times")
 	verbose1 := flag.Bool("v", false, "Verbose")
 	verbose2 := flag.Bool("vv", false, "Verbose detail")
 	quieta := flag.Bool("q", false, "Quiet")
+	ping := flag.Bool("p", false, "Ping server and print round-trip time")
+	push := flag.Bool("push", false, "Accept server push")
+	settings := flag.String("settings", "", "File to persist server settings")
+	priority := flag.Int("pri", 0, "Request priority, 0 is the highest")
+	timeout := flag.Duration("timeout", 0, "Time limit of the requests, 0 waits forever")
+	connectTimeout := flag.Duration("connect-timeout", 0, "Time limit of connect and TLS handshake, 0 waits forever")
+	dialOptions := addDialFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -35,31 +55,30 @@ func main() {
 		os.Exit(1)
 	}
 
-	level := byte(3)
-
-	if *verbose2 {
-		level = 1
-	} else if *verbose1 {
-		level = 2
-	}
-
 	log := spdy.GetLogger()
-	log.SetLevel(level)
-
-	var req *http.Request
-	var err error
+	log.SetLevel(logLevel(*verbose1, *verbose2))
 
-	if *data == "" {
-		req, err = http.NewRequest("GET", *rawurl, nil)
-	} else {
-		req, err = http.NewRequest("POST", *rawurl, bytes.NewBufferString(*data))
+	spdy.DefaultClient.DialTimeout = *connectTimeout
+	spdy.DefaultClient.TLSHandshakeTimeout = *connectTimeout
+	if err := dialOptions.configure(spdy.DefaultClient); err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
 	}
+
+	req, err := newRequest(*rawurl, *data, *times)
 	if err != nil {
 		log.Error("%v", err)
+		return
 	}
 
 	req.Header.Set("user-agent", "gate/0.1.0")
 
+	if *timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
 	if quiet {
 		dump, _ := httputil.DumpRequest(req, false)
 		fmt.Println(string(dump))
@@ -67,20 +86,38 @@ func main() {
 
 	end = make(chan bool, *times)
 
+	if *push {
+		spdy.HandlePush(pushHandle)
+	}
+	if *settings != "" {
+		if err := spdy.PersistSettings(*settings); err != nil {
+			log.Error("%v", err)
+		}
+	}
+
 	fmt.Printf("Init  %v\n", time.Now())
-	id, err := spdy.Request(req, handle)
+	id, err := spdy.RequestWithPriority(req, uint8(*priority), handle)
 	if err != nil {
-		log.Error("%v", err)
+		handle(id, nil, err)
 	}
 	defer spdy.Close()
 	log.Debug("Id#%d is sent", id)
 
+	if *ping {
+		rtt, err := spdy.Ping(req.URL)
+		if err != nil {
+			log.Error("%v", err)
+		} else {
+			fmt.Printf("Ping  %v\n", rtt)
+		}
+	}
+
 	t1 := time.Now()
 	fmt.Printf("Start %v\n", t1)
 	for i := *times - 1; i > 0; i-- {
-		id, err := spdy.Request(req, handle)
+		id, err := spdy.RequestWithPriority(nextRequest(req), uint8(*priority), handle)
 		if err != nil {
-			log.Error("%v", err)
+			handle(id, nil, err)
 		}
 		log.Debug("Id#%d is sent", id)
 	}
@@ -93,6 +130,178 @@ func main() {
 	fmt.Printf("\nRequest %d times(exclude init Session) use %.3fs.\n", *times, (float64(t2.Sub(t1)))/1e9)
 }
 
+// newRequest is a GET of rawurl, or a POST of data when it is set. A body
+// read from a file or stdin is streamed, unless times > 1: then it is read
+// at once, so nextRequest can send it again.
+func newRequest(rawurl, data string, times int) (*http.Request, error) {
+	if data == "" {
+		return http.NewRequest("GET", rawurl, nil)
+	}
+
+	var body io.Reader
+	switch {
+	case data == "@-" && times > 1:
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	case data == "@-":
+		body = os.Stdin
+	case strings.HasPrefix(data, "@") && times > 1:
+		b, err := os.ReadFile(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	case strings.HasPrefix(data, "@"):
+		f, err := os.Open(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		body = f
+	default:
+		body = strings.NewReader(data)
+	}
+	return http.NewRequest("POST", rawurl, body)
+}
+
+// nextRequest is req to send again, with a body of its own.
+func nextRequest(req *http.Request) *http.Request {
+	if req.GetBody == nil {
+		return req
+	}
+	next := req.Clone(req.Context())
+	next.Body, _ = req.GetBody()
+	return next
+}
+
+func logLevel(verbose1, verbose2 bool) byte {
+	if verbose2 {
+		return 1
+	} else if verbose1 {
+		return 2
+	}
+	return 3
+}
+
+// listFlag collects a repeated flag, each may hold comma separated values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// dialFlags are the connection, TLS and proxy options of the commands which
+// dial servers.
+type dialFlags struct {
+	cacert    *string
+	cert      *string
+	key       *string
+	insecure  *bool
+	pins      listFlag
+	proxy     *string
+	resolve   listFlag
+	unix      *string
+	localAddr *string
+	keepAlive *time.Duration
+	protos    listFlag
+	prior     *bool
+	conns     *int
+	pipeline  *int
+	frameSize *int
+}
+
+func addDialFlags(flags *flag.FlagSet) *dialFlags {
+	f := &dialFlags{
+		cacert:    flags.String("cacert", "", "PEM file of the CAs to verify servers with, the system ones by default"),
+		cert:      flags.String("cert", "", "PEM file of the client certificate"),
+		key:       flags.String("key", "", "PEM file of the client certificate key"),
+		insecure:  flags.Bool("insecure", false, "Do not verify server certificates"),
+		proxy:     flags.String("proxy", "", "http:// or socks5:// proxy url, HTTPS_PROXY and NO_PROXY by default"),
+		unix:      flags.String("unix-socket", "", "Connect through this unix socket instead of tcp"),
+		localAddr: flags.String("local-addr", "", "Local ip, or ip:port, to bind connections to"),
+		keepAlive: flags.Duration("keepalive", 0, "Interval of TCP keep-alive probes, 15s by default, negative disables them"),
+		conns:     flags.Int("conns", 0, "Max HTTP/1.1 connections per host, 6 by default"),
+		pipeline:  flags.Int("pipeline", 0, "HTTP/1.1 requests in flight per connection, more than 1 pipelines GET and HEAD"),
+		prior:     flags.Bool("prior-knowledge", false, "Speak the first -proto to servers which do not negotiate, such as spdy on http://"),
+		frameSize: flags.Int("frame-size", 0, "Max bytes of request body in a spdy DataFrame, 16384 by default"),
+	}
+	flags.Var(&f.protos, "proto", "Protocols to speak, preferred first, spdy/3.1,spdy/3,spdy/2,http/1.1 by default")
+	flags.Var(&f.pins, "pin", "SPKI pin sha256//base64 the server chain must have, repeat or separate with commas")
+	flags.Var(&f.resolve, "resolve", "host:port:addr to connect host:port to addr, repeat or separate with commas")
+	return f
+}
+
+// configure sets the dial options on client.
+func (f *dialFlags) configure(client *spdy.Client) error {
+	config, err := spdy.LoadTLSConfig(*f.cacert, *f.cert, *f.key)
+	if err != nil {
+		return err
+	}
+	config.InsecureSkipVerify = *f.insecure
+
+	client.TLSConfig = config
+	client.Pins = f.pins
+	client.Protos = f.protos
+	client.PriorKnowledge = *f.prior
+	client.MaxHttpConns = *f.conns
+	client.HttpPipeline = *f.pipeline
+	client.MaxDataFrameSize = *f.frameSize
+
+	if *f.proxy != "" {
+		proxy, err := url.Parse(*f.proxy)
+		if err != nil {
+			return err
+		}
+		client.Proxy = spdy.ProxyURL(proxy)
+	}
+
+	if *f.unix != "" {
+		client.Dialer = spdy.UnixDialer(*f.unix)
+		return nil
+	}
+	dialer := &spdy.NetDialer{
+		Timeout:   client.DialTimeout,
+		KeepAlive: *f.keepAlive,
+		LocalAddr: *f.localAddr,
+	}
+	for _, r := range f.resolve {
+		parts := strings.SplitN(r, ":", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("Resolve %s is not host:port:addr", r)
+		}
+		if dialer.Resolve == nil {
+			dialer.Resolve = map[string]string{}
+		}
+		dialer.Resolve[net.JoinHostPort(parts[0], parts[1])] = strings.Trim(parts[2], "[]")
+	}
+	client.Dialer = dialer
+	return nil
+}
+
+func pushHandle(url string, associatedId uint32, res *http.Response) {
+	go func() {
+		if !quiet {
+			fmt.Printf("\nPush %s associated to StreamId#%d: \n", url, associatedId)
+			dump, _ := httputil.DumpResponse(res, false)
+			fmt.Println(string(dump))
+		}
+		if res.Body != nil {
+			io.Copy(ioutil.Discard, res.Body)
+		}
+	}()
+}
+
 func handle(streamId uint32, res *http.Response, err error) {
 	go func(){
 		defer func() {
@@ -100,7 +309,8 @@ func handle(streamId uint32, res *http.Response, err error) {
 		}()
 
 		if err != nil {
-			fmt.Printf("< %v", err)
+			fmt.Printf("< %v\n", err)
+			return
 		}
 
 		if quiet {
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gavinsh/gate/spdy"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// gateway terminates spdy, and HTTP/1.1 clients falling back to it, on TLS
+// and forwards requests to the backends in turn. A backend response asks for
+// pushes with the X-Associated-Content header.
+func gateway(args []string) {
+	flags := flag.NewFlagSet("gateway", flag.ExitOnError)
+	listen := flags.String("l", ":443", "Listen address")
+	cert := flags.String("cert", "", "TLS certificate file")
+	key := flags.String("key", "", "TLS key file")
+	backends := flags.String("backend", "", "Comma separated HTTP/1.1 backend urls")
+	maxStreams := flags.Uint("streams", 0, "Max concurrent streams per session, 0 is unlimited")
+	verbose1 := flags.Bool("v", false, "Verbose")
+	verbose2 := flags.Bool("vv", false, "Verbose detail")
+	flags.Parse(args)
+
+	log := spdy.GetLogger()
+	log.SetLevel(logLevel(*verbose1, *verbose2))
+
+	if *cert == "" || *key == "" {
+		fmt.Println("Certificate and key must not blank")
+		os.Exit(1)
+	}
+
+	g, err := newGatewayHandler(strings.Split(*backends, ","))
+	if err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+
+	srv := &spdy.Server{Addr: *listen, Handler: g, MaxConcurrentStreams: uint32(*maxStreams)}
+	fmt.Printf("Gateway listens on %s\n", *listen)
+	if err := srv.ListenAndServeTLS(*cert, *key); err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+}
+
+type gatewayHandler struct {
+	backends []*url.URL
+	next     uint32
+	proxy    *httputil.ReverseProxy
+}
+
+func newGatewayHandler(backends []string) (*gatewayHandler, error) {
+	g := &gatewayHandler{}
+	for _, b := range backends {
+		if b = strings.TrimSpace(b); b == "" {
+			continue
+		}
+		u, err := url.Parse(b)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("Backend %s is not an http url", b)
+		}
+		g.backends = append(g.backends, u)
+	}
+	if len(g.backends) == 0 {
+		return nil, fmt.Errorf("No backend")
+	}
+
+	g.proxy = &httputil.ReverseProxy{Director: g.direct}
+	return g, nil
+}
+
+// direct points the request to the next backend, keeping the Host the client
+// asked for.
+func (g *gatewayHandler) direct(req *http.Request) {
+	b := g.backends[int(atomic.AddUint32(&g.next, 1)-1)%len(g.backends)]
+
+	req.URL.Scheme = b.Scheme
+	req.URL.Host = b.Host
+	if b.Path != "" && b.Path != "/" {
+		req.URL.Path = strings.TrimSuffix(b.Path, "/") + req.URL.Path
+		req.URL.RawPath = ""
+	}
+}
+
+func (g *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.proxy.ServeHTTP(&pushWriter{ResponseWriter: w, req: r}, r)
+}
+
+// pushWriter pushes the urls of X-Associated-Content when the backend
+// response starts, the header itself is not sent to the client.
+type pushWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	started bool
+}
+
+func (w *pushWriter) WriteHeader(status int) {
+	if !w.started {
+		w.started = true
+		w.push()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *pushWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *pushWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *pushWriter) push() {
+	log := spdy.GetLogger()
+
+	header := w.Header()
+	urls := associatedContent(header.Values("X-Associated-Content"))
+	header.Del("X-Associated-Content")
+
+	pusher, ok := w.ResponseWriter.(http.Pusher)
+	if !ok || len(urls) == 0 {
+		return
+	}
+	for _, u := range urls {
+		opts := &http.PushOptions{Header: http.Header{}}
+		for _, k := range []string{"User-Agent", "Accept-Encoding", "Accept-Language", "Cookie"} {
+			if vs, ok := w.req.Header[k]; ok {
+				opts.Header[k] = vs
+			}
+		}
+		if err := pusher.Push(u, opts); err == http.ErrNotSupported {
+			// a pushed response does not push again
+			return
+		} else if err != nil {
+			log.Warn("Push %s: %v", u, err)
+		}
+	}
+}
+
+// associatedContent parses X-Associated-Content values, comma separated
+// quoted urls each optionally followed by :priority. The priority is not
+// used, pushes take the priority of the stream they are associated to.
+func associatedContent(values []string) []string {
+	var urls []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if strings.HasPrefix(item, "\"") {
+				if i := strings.Index(item[1:], "\""); i >= 0 {
+					item = item[1 : i+1]
+				}
+			} else if i := strings.LastIndex(item, ":"); i > 0 && !strings.Contains(item[i:], "/") {
+				item = item[:i]
+			}
+			if item != "" {
+				urls = append(urls, item)
+			}
+		}
+	}
+	return urls
+}
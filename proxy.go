@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gavinsh/gate/spdy"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// hopHeaders are meaningful to a single connection, a proxy does not forward
+// them.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxy listens for HTTP/1.1 proxy requests, and forwards each one as a
+// stream on the spdy session to its origin, sessions are shared by all
+// clients of the proxy.
+func proxy(args []string) {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := flags.String("l", "127.0.0.1:8080", "Listen address")
+	https := flags.Bool("https", false, "Forward http:// requests to https://, to negotiate spdy")
+	verbose1 := flags.Bool("v", false, "Verbose")
+	verbose2 := flags.Bool("vv", false, "Verbose detail")
+	dialOptions := addDialFlags(flags)
+	flags.Parse(args)
+
+	log := spdy.GetLogger()
+	log.SetLevel(logLevel(*verbose1, *verbose2))
+
+	if err := dialOptions.configure(spdy.DefaultClient); err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+
+	defer spdy.Close()
+
+	fmt.Printf("Proxy listens on %s\n", *listen)
+	err := http.ListenAndServe(*listen, &proxyHandler{https: *https})
+	if err != nil {
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+}
+
+type proxyHandler struct {
+	https bool
+}
+
+type proxyResult struct {
+	res *http.Response
+	err error
+}
+
+func (p *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := spdy.GetLogger()
+
+	if r.Method == "CONNECT" {
+		http.Error(w, "CONNECT is not supported, request http:// urls", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "Request must be for an absolute url", http.StatusBadRequest)
+		return
+	}
+
+	u := *r.URL
+	if p.https && u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+
+	var body io.Reader
+	if r.ContentLength != 0 {
+		body = r.Body
+	}
+	// the client going away cancels the stream, or the one replaying it
+	// after GOAWAY
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, u.String(), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out.Host = r.Host
+	out.ContentLength = r.ContentLength
+	out.Header = r.Header.Clone()
+	removeHopHeaders(out.Header)
+
+	result := make(chan proxyResult, 1)
+	id, err := spdy.Request(out, func(streamId uint32, res *http.Response, err error) {
+		result <- proxyResult{res, err}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var res *http.Response
+	select {
+	case rr := <-result:
+		if rr.err != nil {
+			log.Error("%s %s: %v", r.Method, u.String(), rr.err)
+			http.Error(w, rr.err.Error(), http.StatusBadGateway)
+			return
+		}
+		res = rr.res
+	case <-r.Context().Done():
+		log.Debug("Client of Stream#%d has gone", id)
+		return
+	}
+	if res.Body != nil {
+		defer res.Body.Close()
+	}
+
+	header := w.Header()
+	for k, vs := range res.Header {
+		header[k] = vs
+	}
+	removeHopHeaders(header)
+	// spdy/2 carries the status line in the headers
+	header.Del("Status")
+	header.Del("Version")
+
+	w.WriteHeader(res.StatusCode)
+	if res.Body != nil {
+		io.Copy(w, res.Body)
+	}
+	for k, vs := range res.Trailer {
+		header[http.TrailerPrefix+k] = vs
+	}
+}
+
+// removeHopHeaders deletes hopHeaders, and the headers the Connection header
+// names.
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				header.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		header.Del(k)
+	}
+}
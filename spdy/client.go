@@ -1,20 +1,154 @@
 package spdy
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Handle receives the stream id and the response, or the error, of a
+// request. It is called by the goroutine reading the session, which waits
+// for it: the response body must be read from another goroutine, and Handle
+// must not block. The response's Header is that of SYN_REPLY and does not
+// change afterwards, HEADERS frames the server sends later, before the end
+// of the body or with it, are merged into its Trailer, which is complete
+// once the body returns io.EOF.
 type Handle func(uint32, *http.Response, error)
 
-var sessions map[string]Session
+// PushHandle receives the url, the associated stream id and the response of
+// a stream pushed by the server. As Handle, it is called by the goroutine
+// reading the session and must not block, the response body is read from
+// another goroutine.
+type PushHandle func(string, uint32, *http.Response)
 
-func init() {
-	sessions = map[string]Session{}
+// SpdyProtos are the spdy protocols negotiated over TLS, preferred first.
+var SpdyProtos = []string{"spdy/3.1", "spdy/3", "spdy/2"}
+
+// knownProto tells whether a session can speak proto.
+func knownProto(proto string) bool {
+	return proto == "http/1.1" || slices.Contains(SpdyProtos, proto)
+}
+
+// protoVersion returns the spdy version of a negotiated protocol, and whether
+// it adds the session flow control of spdy/3.1.
+func protoVersion(proto string) (uint16, bool) {
+	if proto == "spdy/2" {
+		return 2, false
+	}
+	return 3, proto == "spdy/3.1"
+}
+
+// Client keeps a session per host and sends requests on them. Clients do not
+// share sessions or configuration, so a process can talk to servers with
+// different certificates, loggers or headers.
+type Client struct {
+	// TLSConfig is used for https hosts, NextProtos defaults to Protos,
+	// ServerName to the host. When nil, certificates are
+	// verified against the system roots. LoadTLSConfig sets up the CA and
+	// client certificate from files.
+	TLSConfig *tls.Config
+
+	// Pins are SPKI pins as SPKIPin returns them, the verified chain of a
+	// server must have one of them when they are set. They are checked
+	// even when TLSConfig skips verification, against the certificate of
+	// the server alone then.
+	Pins []string
+
+	// Protos are the protocols spoken, preferred first, SpdyProtos then
+	// http/1.1 when empty. https servers choose one of them by ALPN, NPN
+	// is not supported by crypto/tls. Plain http servers are spoken spdy/2
+	// when it is one of Protos, and servers which do not negotiate
+	// http/1.1 when it is.
+	Protos []string
+
+	// PriorKnowledge speaks the first of Protos to servers which do not
+	// negotiate, such as cleartext spdy on plain http.
+	PriorKnowledge bool
+
+	// MaxHttpConns bounds the connections of a HTTP/1.1 session,
+	// DEFAULT_HTTP_CONNS when 0, and HttpPipeline is the number of
+	// requests each has in flight, see HttpSession.
+	MaxHttpConns int
+	HttpPipeline int
+
+	// MaxDataFrameSize bounds the DataFrames of request bodies on spdy
+	// sessions, DEFAULT_DATA_FRAME_SIZE when 0.
+	MaxDataFrameSize int
+
+	// Dialer opens the connections to servers and proxies, a NetDialer
+	// with DialTimeout when nil.
+	Dialer Dialer
+
+	// Proxy returns the proxy to dial a scheme://host:port url through, an
+	// http:// one tunneling with CONNECT or a socks5:// one. Hosts are
+	// dialed directly when it is nil or returns nil. TLS and the protocol
+	// negotiation run over the tunnel.
+	Proxy func(*url.URL) (*url.URL, error)
+
+	// Logger of the client and its sessions, the package logger when nil.
+	Logger *Logger
+
+	// Header is added to requests which do not set it.
+	Header http.Header
+
+	// PushHandle receives streams pushed on sessions created afterwards,
+	// pushes are refused when it is nil.
+	PushHandle PushHandle
+
+	// SettingsStore keeps the settings servers ask to persist, they are not
+	// kept when it is nil.
+	SettingsStore *SettingsStore
+
+	// Timeouts of each phase of a request, 0 waits forever. DialTimeout
+	// bounds the tcp connect when Dialer is nil and the proxy handshake,
+	// TLSHandshakeTimeout the handshake, and the others are those of
+	// SpdySession. The request's context bounds the
+	// whole request.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	BodyIdleTimeout       time.Duration
+
+	// lock guards sessions and dials, clients such as gate proxy request
+	// from many goroutines. A host being dialed is in dials, so concurrent
+	// requests to it wait for the same handshake.
+	lock     sync.Mutex
+	sessions map[string]Session
+	dials    map[string]*dialCall
+}
+
+// dialCall is a session being set up, done is closed once se or err is set.
+// The requests waiting for it are counted in waiters, the dial is canceled
+// when the last one gives up.
+type dialCall struct {
+	done    chan bool
+	se      Session
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+var defaultSettingsStore, _ = NewSettingsStore("")
+
+// DefaultClient is the Client of the package functions.
+var DefaultClient = &Client{
+	SettingsStore: defaultSettingsStore,
+	Proxy:         ProxyFromEnvironment,
+}
+
+func (c *Client) logger() *Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return log
 }
 
 func addPort(scheme, host string) string {
@@ -24,8 +158,6 @@ func addPort(scheme, host string) string {
 			host += ":80"
 		case "https":
 			host += ":443"
-		default:
-			log.Error("unkown scheme: %v", scheme)
 		}
 	}
 
@@ -33,45 +165,300 @@ func addPort(scheme, host string) string {
 }
 
 func Request(req *http.Request, handle Handle) (uint32, error) {
+	return DefaultClient.Request(req, handle)
+}
+
+// RequestContext sends req with ctx on DefaultClient, see
+// Client.RequestContext.
+func RequestContext(ctx context.Context, req *http.Request, handle Handle) (uint32, error) {
+	return DefaultClient.RequestContext(ctx, req, handle)
+}
+
+// RequestWithPriority sends req on DefaultClient, see
+// Client.RequestWithPriority.
+func RequestWithPriority(req *http.Request, priority uint8, handle Handle) (uint32, error) {
+	return DefaultClient.RequestWithPriority(req, priority, handle)
+}
+
+// CancelStream resets streamId on the session of DefaultClient serving req's
+// host.
+func CancelStream(req *http.Request, streamId uint32) error {
+	return DefaultClient.CancelStream(req, streamId)
+}
+
+// Ping measures the round-trip time of the spdy session of DefaultClient to
+// u's host.
+func Ping(u *url.URL) (time.Duration, error) {
+	return DefaultClient.Ping(u)
+}
+
+func Close() {
+	DefaultClient.Close()
+}
+
+// HandlePush accepts server push on sessions of DefaultClient created
+// afterwards, pushes are refused when handle is nil.
+func HandlePush(handle PushHandle) {
+	DefaultClient.PushHandle = handle
+}
+
+// PersistSettings keeps the settings servers ask DefaultClient to persist in
+// file path, so they survive the process.
+func PersistSettings(path string) error {
+	store, err := NewSettingsStore(path)
+	if err != nil {
+		return err
+	}
+	DefaultClient.SettingsStore = store
+	return nil
+}
+
+func DialTCP(host string) (net.Conn, error) {
+	return DefaultClient.dialTCP(context.Background(), "http", host)
+}
+
+func DialTLS(host string) (net.Conn, string, error) {
+	return DefaultClient.dialTLS(context.Background(), host)
+}
+
+func (c *Client) Request(req *http.Request, handle Handle) (uint32, error) {
+	return c.RequestWithPriority(req, 0, handle)
+}
+
+// RequestContext sends req, the stream is reset with CANCEL and handle gets
+// ctx's error, such as context.DeadlineExceeded, once ctx is done.
+func (c *Client) RequestContext(ctx context.Context, req *http.Request, handle Handle) (uint32, error) {
+	return c.RequestWithPriority(req.WithContext(ctx), 0, handle)
+}
+
+// RequestWithPriority sends req with priority, 0 is the highest, so a page
+// can fetch what blocks rendering before images. Priority is ignored by
+// HTTP/1.1 sessions.
+func (c *Client) RequestWithPriority(req *http.Request, priority uint8, handle Handle) (uint32, error) {
+	log := c.logger()
 	host := addPort(req.URL.Scheme, req.Host)
+	req = c.withHeader(req)
 
-	se, err := getSession(req.URL.Scheme, host)
+	se, err := c.getSession(req.Context(), req.URL.Scheme, host)
 	if err != nil {
 		log.Error("%v", err)
 		return 0, err
 	}
 
-	id := se.Request(req, handle)
+	id, err := request(se, req, priority, handle)
+	if err == ErrSessionGoingAway || err == ErrSessionClosed {
+		log.Debug("Session to %s: %v, use a new one", host, err)
+		c.removeSession(se)
+		if se, err = c.getSession(req.Context(), req.URL.Scheme, host); err != nil {
+			log.Error("%v", err)
+			return 0, err
+		}
+		id, err = request(se, req, priority, handle)
+	}
+	if err != nil {
+		log.Error("%v", err)
+		return 0, err
+	}
 	log.Trace("Wait Response with StreamId %d", id)
 
 	return id, nil
 }
 
-func Close() {
-	for _, s := range sessions {
+// withHeader returns req with the client's Header it does not set, req is
+// copied rather than modified.
+func (c *Client) withHeader(req *http.Request) *http.Request {
+	var header http.Header
+	for k, vs := range c.Header {
+		if _, ok := req.Header[k]; ok {
+			continue
+		}
+		if header == nil {
+			header = req.Header.Clone()
+			if header == nil {
+				header = http.Header{}
+			}
+		}
+		header[k] = vs
+	}
+	if header == nil {
+		return req
+	}
+
+	r := *req
+	r.Header = header
+	return &r
+}
+
+func request(se Session, req *http.Request, priority uint8, handle Handle) (uint32, error) {
+	if ss, ok := se.(*SpdySession); ok {
+		return ss.RequestWithPriority(req, priority, handle)
+	}
+	return se.Request(req, handle)
+}
+
+// replay sends req again on a fresh session after the server went away
+// without processing it. The handle will see the new stream id.
+func (c *Client) replay(req *http.Request, priority uint8, handle Handle) {
+	if req.Body != nil {
+		if req.GetBody == nil {
+			handle(0, nil, errors.New("Request body can not be replayed after GOAWAY"))
+			return
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			handle(0, nil, err)
+			return
+		}
+		r := *req
+		r.Body = body
+		req = &r
+	}
+
+	if _, err := c.RequestWithPriority(req, priority, handle); err != nil {
+		handle(0, nil, err)
+	}
+}
+
+// CancelStream resets streamId on the session serving req's host.
+func (c *Client) CancelStream(req *http.Request, streamId uint32) error {
+	host := addPort(req.URL.Scheme, req.Host)
+
+	c.lock.Lock()
+	se, ok := c.sessions[host]
+	c.lock.Unlock()
+	if !ok {
+		return errors.New("Session not exist for " + host)
+	}
+
+	return se.CancelStream(streamId)
+}
+
+// Ping measures the round-trip time of the spdy session to u's host.
+func (c *Client) Ping(u *url.URL) (time.Duration, error) {
+	host := addPort(u.Scheme, u.Host)
+
+	se, err := c.getSession(context.Background(), u.Scheme, host)
+	if err != nil {
+		c.logger().Error("%v", err)
+		return 0, err
+	}
+
+	ss, ok := se.(*SpdySession)
+	if !ok {
+		return 0, errors.New("Ping is only supported by spdy session")
+	}
+
+	return ss.Ping()
+}
+
+// Close closes the sessions of the client, requests afterwards open new
+// ones.
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for host, s := range c.sessions {
 		s.Close()
+		delete(c.sessions, host)
 	}
 }
 
-func getSession(scheme, host string) (Session, error) {
-	se, ok := sessions[host]
-	if ok == true {
+func (c *Client) removeSession(s Session) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for host, se := range c.sessions {
+		if se == s {
+			delete(c.sessions, host)
+		}
+	}
+}
+
+// getSession returns the session to host, the first request to a host dials
+// it while later ones wait, the lock is not held while dialing so other hosts
+// are not blocked. A request stops waiting when ctx is done.
+func (c *Client) getSession(ctx context.Context, scheme, host string) (Session, error) {
+	log := c.logger()
+
+	c.lock.Lock()
+	if se, ok := c.sessions[host]; ok {
+		c.lock.Unlock()
 		if log.DebugEnabled() {
 			log.Debug("Use existed session")
 		}
+		return se, nil
+	}
+	call, ok := c.dials[host]
+	if ok {
+		log.Debug("Wait for session to %s being dialed", host)
 	} else {
-		var err error
-		se, err = initSession(scheme, host)
-		if err != nil {
-			log.Error("%v", err)
-			return nil, err
+		dialCtx, cancel := context.WithCancel(context.Background())
+		call = &dialCall{done: make(chan bool), cancel: cancel}
+		if c.dials == nil {
+			c.dials = map[string]*dialCall{}
+		}
+		c.dials[host] = call
+		go c.dialSession(dialCtx, call, scheme, host)
+	}
+	call.waiters++
+	c.lock.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			log.Error("%v", call.err)
+		}
+		return call.se, call.err
+	case <-ctx.Done():
+		c.lock.Lock()
+		call.waiters--
+		if call.waiters == 0 && c.dials[host] == call {
+			// nobody waits, a later request dials again
+			log.Debug("Dial to %s canceled: %v", host, ctx.Err())
+			delete(c.dials, host)
+			call.cancel()
 		}
+		c.lock.Unlock()
+		return nil, ctx.Err()
 	}
-	return se, nil
 }
 
-func initSession(scheme, host string) (s Session, err error) {
-	conn, proto, err := connect(scheme, host)
+// dialSession sets up the session of call and serves it before other
+// requests can see it.
+func (c *Client) dialSession(ctx context.Context, call *dialCall, scheme, host string) {
+	defer call.cancel()
+
+	call.se, call.err = c.initSession(ctx, scheme, host)
+	if call.err == nil {
+		call.se.Serve()
+		c.logger().Debug("Session to %s is Serving", host)
+	}
+
+	c.lock.Lock()
+	if c.dials[host] == call {
+		delete(c.dials, host)
+	}
+	if call.err == nil {
+		if c.sessions == nil {
+			c.sessions = map[string]Session{}
+		}
+		if _, ok := c.sessions[host]; ok {
+			// a redial won while this one was canceled
+			call.se.Close()
+		} else {
+			c.sessions[host] = call.se
+		}
+	}
+	c.lock.Unlock()
+	close(call.done)
+}
+
+// initSession connects to host and sets up the session of the negotiated
+// protocol, getSession serves it.
+func (c *Client) initSession(ctx context.Context, scheme, host string) (s Session, err error) {
+	log := c.logger()
+
+	conn, proto, err := c.connect(ctx, scheme, host)
 	if err != nil {
 		log.Error("%v", err)
 		return nil, err
@@ -81,42 +468,136 @@ func initSession(scheme, host string) (s Session, err error) {
 
 	switch proto {
 	case "http/1.1", "":
-		s = NewHttpSession(conn)
-	case "spdy/2":
-		s = NewSpdySession(conn, conn, conn, 2)
+		hs := NewHttpSession(conn)
+		hs.Logger = log
+		hs.MaxConns = c.MaxHttpConns
+		hs.Pipeline = c.HttpPipeline
+		hs.Dial = func() (net.Conn, error) {
+			return c.connectHttp(scheme, host)
+		}
+		s = hs
+	case "spdy/2", "spdy/3", "spdy/3.1":
+		version, sessionFlow := protoVersion(proto)
+		se := NewSpdySession(conn, conn, conn, version)
+		se.SessionFlowControl = sessionFlow
+		se.PushHandle = c.PushHandle
+		se.SettingsStore = c.SettingsStore
+		se.Origin = host
+		se.Logger = log
+		se.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+		se.BodyIdleTimeout = c.BodyIdleTimeout
+		se.MaxDataFrameSize = c.MaxDataFrameSize
+		se.client = c
+		s = se
 	default:
-		log.Fatal("Proto no support")
-		err = errors.New("Unreachable code")
+		log.Fatal("Proto %s no support", proto)
+		conn.Close()
+		return nil, errors.New("Proto no support: " + proto)
 	}
 
-	sessions[host] = s
-	s.Serve()
-
-	log.Debug("Session from %s to %s is Serving", conn.LocalAddr(), conn.RemoteAddr())
-	return s, err
+	return s, nil
 }
 
-func connect(scheme, host string) (conn net.Conn, proto string, err error) {
-	proto = "spdy/2"
+func (c *Client) connect(ctx context.Context, scheme, host string) (conn net.Conn, proto string, err error) {
+	for _, p := range c.protos() {
+		if !knownProto(p) {
+			c.logger().Error("Proto %s no support", p)
+			return nil, "", errors.New("Proto no support: " + p)
+		}
+	}
+
 	switch scheme {
 	case "http":
-		conn, err = DialTCP(host)
+		conn, err = c.dialTCP(ctx, scheme, host)
 	case "https":
-		conn, proto, err = DialTLS(host)
+		conn, proto, err = c.dialTLS(ctx, host)
 	default:
-		log.Error("%v", "unreachable code")
+		c.logger().Error("%v", "unreachable code")
 		return nil, "", errors.New("Unreachable code")
 	}
 	if err != nil {
-		log.Error("%v", err)
+		c.logger().Error("%v", err)
 		return nil, "", err
 	}
 
+	if proto, err = c.selectProto(scheme, host, proto); err != nil {
+		c.logger().Error("%v", err)
+		conn.Close()
+		return nil, "", err
+	}
 	return conn, proto, nil
 }
 
-func DialTCP(host string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", host)
+// connectHttp opens another connection of the HTTP/1.1 session to host.
+func (c *Client) connectHttp(scheme, host string) (net.Conn, error) {
+	conn, proto, err := c.connect(context.Background(), scheme, host)
+	if err != nil {
+		return nil, err
+	}
+	if proto != "http/1.1" {
+		conn.Close()
+		return nil, fmt.Errorf("%s negotiated %s for a http/1.1 session", host, proto)
+	}
+	return conn, nil
+}
+
+func (c *Client) protos() []string {
+	if len(c.Protos) > 0 {
+		return c.Protos
+	}
+	return append(append([]string{}, SpdyProtos...), "http/1.1")
+}
+
+// selectProto picks the protocol spoken to scheme://host, negotiated is the
+// one chosen by ALPN if any.
+func (c *Client) selectProto(scheme, host, negotiated string) (string, error) {
+	log := c.logger()
+	protos := c.protos()
+
+	switch {
+	case negotiated != "":
+		if !knownProto(negotiated) {
+			return "", errors.New("Proto no support: " + negotiated)
+		}
+		log.Debug("Protocol %s of %s chosen by ALPN", negotiated, host)
+		return negotiated, nil
+	case c.PriorKnowledge:
+		log.Debug("Protocol %s of %s chosen by prior knowledge", protos[0], host)
+		return protos[0], nil
+	case scheme == "http" && slices.Contains(protos, "spdy/2"):
+		log.Debug("Protocol spdy/2 of %s chosen by default for http", host)
+		return "spdy/2", nil
+	case slices.Contains(protos, "http/1.1"):
+		log.Debug("Protocol http/1.1 of %s chosen by default, none was negotiated", host)
+		return "http/1.1", nil
+	}
+	return "", fmt.Errorf("%s negotiated none of %s and there is no prior knowledge", host, strings.Join(protos, ","))
+}
+
+// dialTCP connects to host, through the proxy Proxy picks for
+// scheme://host.
+func (c *Client) dialTCP(ctx context.Context, scheme, host string) (net.Conn, error) {
+	if c.Proxy != nil {
+		proxy, err := c.Proxy(&url.URL{Scheme: scheme, Host: host})
+		if err != nil {
+			return nil, err
+		}
+		if proxy != nil {
+			c.logger().Debug("Dial %s through proxy %s", host, proxy.Redacted())
+			return c.dialProxy(ctx, proxy, host)
+		}
+	}
+
+	return c.dial(ctx, "tcp", host)
+}
+
+func (c *Client) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &NetDialer{Timeout: c.DialTimeout}
+	}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -124,28 +605,53 @@ func DialTCP(host string) (net.Conn, error) {
 	return conn, nil
 }
 
-func DialTLS(host string) (net.Conn, string, error) {
-	config := &tls.Config{
-		NextProtos:         []string{"spdy/2", "http/1.1"},
-		InsecureSkipVerify: true,
+func (c *Client) dialTLS(ctx context.Context, host string) (net.Conn, string, error) {
+	log := c.logger()
+
+	config := &tls.Config{}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = c.protos()
+	}
+	if config.ServerName == "" {
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			config.ServerName = name
+		}
 	}
 
-	conn, err := tls.Dial("tcp", host, config)
+	raw, err := c.dialTCP(ctx, "https", host)
 	if err != nil {
 		log.Error("%v", err)
 		return nil, "", err
 	}
+	conn := tls.Client(raw, config)
+	if c.TLSHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.TLSHandshakeTimeout)
+		defer cancel()
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		log.Error("%v", err)
+		raw.Close()
+		return nil, "", err
+	}
 
 	state := conn.ConnectionState()
-	if log.Level <= INFO {
+	if log.DebugEnabled() {
 		for _, v := range state.PeerCertificates {
-			publicKey, err := x509.MarshalPKIXPublicKey(v.PublicKey)
-			if err != nil {
-				log.Error("%v", err)
-				return nil, "", err
-			}
-			log.Debug("PublicKey = %x\n", publicKey)
 			log.Debug("Subject = %v", v.Subject)
+			log.Debug("Pin = %s", SPKIPin(v))
+		}
+	}
+	log.Debug("TLS %s, cipher %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+
+	if len(c.Pins) > 0 {
+		if err := checkPins(state, config.InsecureSkipVerify, c.Pins); err != nil {
+			log.Error("%s: %v", host, err)
+			conn.Close()
+			return nil, "", err
 		}
 	}
 
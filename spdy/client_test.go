@@ -0,0 +1,201 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer serves handler with spdy over TLS, falling back to HTTP/1.1.
+func newTestServer(t *testing.T, handler http.Handler) *httptest.Server {
+	ts := httptest.NewUnstartedServer(handler)
+	(&Server{}).ConfigureServer(ts.Config)
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// Concurrent first requests to a host share one session, which is served
+// before any of them can use it. Run with -race.
+func TestClientConcurrentFirstRequests(t *testing.T) {
+	body := strings.Repeat("x", 1<<10)
+	ts := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+
+	for round := 0; round < 20; round++ {
+		var dials int32
+		dial := func(_ context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial(network, addr)
+		}
+		c := &Client{TLSConfig: &tls.Config{InsecureSkipVerify: true}, Dialer: DialFunc(dial)}
+		client := &http.Client{Transport: &Transport{Client: c}}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := client.Post(ts.URL, "text/plain", strings.NewReader(body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer res.Body.Close()
+				b, err := io.ReadAll(res.Body)
+				if err != nil || string(b) != body {
+					t.Errorf("body of %d bytes, err %v", len(b), err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := atomic.LoadInt32(&dials); n != 1 {
+			t.Errorf("%d dials, want 1", n)
+		}
+		c.lock.Lock()
+		for _, se := range c.sessions {
+			if ss, ok := se.(*SpdySession); !ok || !ss.SessionFlowControl {
+				t.Errorf("session %T, want spdy/3.1", se)
+			}
+		}
+		c.lock.Unlock()
+		c.Close()
+	}
+}
+
+// stalledListener accepts connections and never answers on them.
+func stalledListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return l
+}
+
+// A server accepting tcp but stalling the TLS handshake does not hold a
+// request past its context, nor another request waiting for the same dial.
+func TestClientContextBoundsDial(t *testing.T) {
+	l := stalledListener(t)
+	c := &Client{}
+	defer c.Close()
+
+	errs := make(chan error, 2)
+	for _, d := range []time.Duration{100 * time.Millisecond, 300 * time.Millisecond} {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), d)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, "GET", "https://"+l.Addr().String()+"/", nil)
+			_, err := c.Request(req, func(uint32, *http.Response, error) {})
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("err = %v, want context.DeadlineExceeded", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("request blocked past its context")
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.dials) != 0 {
+		t.Errorf("%d dials left", len(c.dials))
+	}
+}
+
+func TestTransportTimeoutDuringConnect(t *testing.T) {
+	l := stalledListener(t)
+	c := &Client{}
+	defer c.Close()
+	client := &http.Client{Transport: &Transport{Client: c}, Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	if _, err := client.Get("https://" + l.Addr().String() + "/"); err == nil {
+		t.Fatal("request to a stalled server succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("request took %v past a timeout of 100ms", d)
+	}
+}
+
+func TestClientMaxDataFrameSize(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	ts := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	c := &Client{TLSConfig: &tls.Config{InsecureSkipVerify: true}, MaxDataFrameSize: 100}
+	defer c.Close()
+
+	res, err := (&http.Client{Transport: &Transport{Client: c}}).Post(ts.URL, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(b) != body {
+		t.Errorf("body of %d bytes, want %d", len(b), len(body))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, se := range c.sessions {
+		if ss := se.(*SpdySession); ss.MaxDataFrameSize != 100 {
+			t.Errorf("session MaxDataFrameSize %d, want 100", ss.MaxDataFrameSize)
+		}
+	}
+}
+
+func TestClientSelectProto(t *testing.T) {
+	for _, tt := range []struct {
+		protos     []string
+		prior      bool
+		scheme     string
+		negotiated string
+		want       string
+	}{
+		{nil, false, "https", "spdy/3.1", "spdy/3.1"},
+		{nil, false, "https", "", "http/1.1"},
+		{nil, false, "http", "", "spdy/2"},
+		{[]string{"http/1.1"}, false, "http", "", "http/1.1"},
+		{[]string{"spdy/3", "http/1.1"}, false, "http", "", "http/1.1"},
+		{[]string{"spdy/3", "http/1.1"}, true, "http", "", "spdy/3"},
+		{[]string{"spdy/3"}, true, "https", "", "spdy/3"},
+		{[]string{"spdy/3"}, false, "https", "", ""},
+		{nil, false, "https", "h2", ""},
+	} {
+		c := &Client{Protos: tt.protos, PriorKnowledge: tt.prior}
+		got, err := c.selectProto(tt.scheme, "example.com:443", tt.negotiated)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("%v prior %v %s negotiating %q: %q, %v, want %q",
+				tt.protos, tt.prior, tt.scheme, tt.negotiated, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package spdy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Dialer opens the connections of a Client, to a proxy when one is used. The
+// network is "tcp" and the address is host:port, the dial is abandoned when
+// ctx is done. *net.Dialer is a Dialer, and so are NetDialer and DialFunc.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialFunc is a function used as a Dialer, for instance returning one end of
+// a net.Pipe served in the test.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// UnixDialer connects every address to the unix socket at path, such as a
+// local sidecar forwarding to the servers.
+func UnixDialer(path string) Dialer {
+	return DialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	})
+}
+
+// NetDialer dials tcp with the socket options of the connection. Zero values
+// keep the defaults of the system and of package net.
+type NetDialer struct {
+	// Timeout of the connect, 0 waits forever.
+	Timeout time.Duration
+
+	// KeepAlive is the interval of TCP keep-alive probes, 15s when 0 and
+	// disabled when negative.
+	KeepAlive time.Duration
+
+	// Nagle turns off TCP_NODELAY, which package net sets, so small
+	// writes are batched.
+	Nagle bool
+
+	// LocalAddr is the local ip, or ip:port, connections are bound to.
+	LocalAddr string
+
+	// ReadBuffer and WriteBuffer size the socket buffers.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// Resolve maps host:port addresses to the ip, or ip:port, to connect
+	// to instead, as --resolve of curl does. The name is still used for TLS
+	// and the Host header.
+	Resolve map[string]string
+}
+
+func (d *NetDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: d.Timeout, KeepAlive: d.KeepAlive}
+	if d.LocalAddr != "" {
+		local, err := resolveLocal(d.LocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = local
+	}
+
+	if to, ok := d.Resolve[addr]; ok {
+		if _, _, err := net.SplitHostPort(to); err != nil {
+			_, port, _ := net.SplitHostPort(addr)
+			to = net.JoinHostPort(to, port)
+		}
+		addr = to
+	}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if d.Nagle {
+			err = tcp.SetNoDelay(false)
+		}
+		if err == nil && d.ReadBuffer > 0 {
+			err = tcp.SetReadBuffer(d.ReadBuffer)
+		}
+		if err == nil && d.WriteBuffer > 0 {
+			err = tcp.SetWriteBuffer(d.WriteBuffer)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// resolveLocal parses the bind address of NetDialer, the port is optional.
+func resolveLocal(addr string) (*net.TCPAddr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	return net.ResolveTCPAddr("tcp", addr)
+}
@@ -0,0 +1,290 @@
+package spdy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// DEFAULT_WINDOW_SIZE is the initial flow control window of spdy/3, for
+// streams and for the spdy/3.1 session.
+const DEFAULT_WINDOW_SIZE = 64 * 1024
+
+// MAX_WINDOW_SIZE is the largest window a WINDOW_UPDATE may grow to.
+const MAX_WINDOW_SIZE = 0x7fffffff
+
+// window is a send window, the sender takes bytes from it and waits when it is
+// used up, until WINDOW_UPDATE adds them back.
+type window struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	size   int64
+	closed bool
+}
+
+func newWindow(size int64) *window {
+	w := &window{size: size}
+	w.cond = sync.NewCond(&w.lock)
+	return w
+}
+
+// take waits for the window to open, and takes at most n bytes from it. It
+// returns 0 once the window is closed.
+func (w *window) take(n int64) int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for w.size <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0
+	}
+
+	if n > w.size {
+		n = w.size
+	}
+	w.size -= n
+	return n
+}
+
+// add grows the window by delta, which is negative when SETTINGS shrink the
+// initial window size. It returns false if the window overflows.
+func (w *window) add(delta int64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.size += delta
+	w.cond.Broadcast()
+
+	return w.size <= MAX_WINDOW_SIZE
+}
+
+func (w *window) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// streamBody buffers the DATA of a stream, so a slow reader does not block
+// the session. The peer can not overrun it, the receive window bounds it.
+type streamBody struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	err      error
+	consumed func(int)
+}
+
+func newStreamBody(consumed func(int)) *streamBody {
+	b := &streamBody{consumed: consumed}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *streamBody) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.buf.Write(p)
+	b.cond.Broadcast()
+
+	return n, err
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		err := b.err
+		b.lock.Unlock()
+		return 0, err
+	}
+	n, _ := b.buf.Read(p)
+	b.lock.Unlock()
+
+	if b.consumed != nil {
+		b.consumed(n)
+	}
+	return n, nil
+}
+
+// Close ends the body, the reader gets io.EOF after the buffered data.
+func (b *streamBody) Close() error {
+	return b.CloseWithError(io.EOF)
+}
+
+// CloseWithError ends the body, the reader gets err after the buffered data.
+func (b *streamBody) CloseWithError(err error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+
+	return nil
+}
+
+// recvWindow accounts a receive window, DATA takes from it and the reader
+// gives the bytes back, which are announced by WINDOW_UPDATE once half of the
+// initial window is consumed.
+type recvWindow struct {
+	lock     sync.Mutex
+	initial  int64
+	size     int64
+	consumed int64
+	fin      bool
+}
+
+func newRecvWindow(size int64) *recvWindow {
+	return &recvWindow{initial: size, size: size}
+}
+
+// take takes n bytes of DATA from the window, it returns false if the peer
+// overruns the window. No WINDOW_UPDATE is due after fin.
+func (w *recvWindow) take(n int64, fin bool) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.fin = w.fin || fin
+	w.size -= n
+
+	return w.size >= 0
+}
+
+// give returns n consumed bytes to the window, and the delta to announce by
+// WINDOW_UPDATE, 0 until half of the window is consumed.
+func (w *recvWindow) give(n int64) int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.consumed += n
+	if w.fin || w.consumed < w.initial/2 {
+		return 0
+	}
+
+	delta := w.consumed
+	w.consumed = 0
+	w.size += delta
+	return delta
+}
+
+// takeWindows takes at most n bytes from a stream send window, and from the
+// spdy/3.1 session window if there is one. It waits for both to open, and
+// returns 0 once either is closed.
+func takeWindows(stream, session *window, n int64) int64 {
+	if n = stream.take(n); n == 0 || session == nil {
+		return n
+	}
+
+	m := session.take(n)
+	if m > 0 {
+		// give back what the session window can not afford
+		stream.add(n - m)
+	}
+	return m
+}
+
+// consumed is called as the response body is read, and sends WINDOW_UPDATE
+// once half of the receive window is consumed.
+func (st *Stream) consumed(n int) {
+	se := st.session
+	if se == nil || st.recvWindow == nil {
+		return
+	}
+	se.consumed(n)
+
+	if delta := st.recvWindow.give(int64(n)); delta > 0 {
+		st.logger.Trace("Stream#%d receive window grows %d", st.StreamId, delta)
+		se.output.push(NewWindowUpdateFrame(st.StreamId, uint32(delta)))
+	}
+}
+
+// consumed returns DATA bytes to the spdy/3.1 session receive window.
+func (se *SpdySession) consumed(n int) {
+	if !se.SessionFlowControl {
+		return
+	}
+
+	if delta := se.recvWindow.give(int64(n)); delta > 0 {
+		se.Logger.Trace("Session receive window grows %d", delta)
+		se.output.push(NewWindowUpdateFrame(0, uint32(delta)))
+	}
+}
+
+// receiveData checks a DataFrame against the receive windows, and resets the
+// stream which overruns its window.
+func (se *SpdySession) receiveData(dat *DataFrame, st *Stream) bool {
+	if se.Version < 3 {
+		return true
+	}
+
+	if se.SessionFlowControl && !se.recvWindow.take(int64(dat.Length), false) {
+		se.Logger.Error("Session receive window is overrun by Stream#%d", dat.StreamId)
+	}
+
+	if st == nil {
+		// nobody will read the data, return it to the session at once
+		se.consumed(int(dat.Length))
+		return false
+	}
+
+	if !st.recvWindow.take(int64(dat.Length), dat.Flags&FLAG_FIN != 0) {
+		se.Logger.Error("Stream#%d receive window is overrun", dat.StreamId)
+		se.consumed(int(dat.Length))
+		se.resetStream(st, FLOW_CONTROL_ERROR)
+		return false
+	}
+	return true
+}
+
+// windowUpdate grows the send window of a stream, or of the session when the
+// stream id is 0.
+func (se *SpdySession) windowUpdate(wu *WindowUpdateFrame) {
+	if wu.StreamId == 0 {
+		if se.sendWindow == nil {
+			se.Logger.Warn("Session WINDOW_UPDATE without spdy/3.1, ignore it")
+			return
+		}
+		if !se.sendWindow.add(int64(wu.DeltaWindowSize)) {
+			se.Logger.Error("Session send window overflows")
+		}
+		return
+	}
+
+	st, ok := se.stream(wu.StreamId)
+	if !ok || st.sendWindow == nil {
+		se.Logger.Debug("Stream#%d not exist in Session, ignore %v", wu.StreamId, wu)
+		return
+	}
+	if !st.sendWindow.add(int64(wu.DeltaWindowSize)) {
+		se.Logger.Error("Stream#%d send window overflows", wu.StreamId)
+		se.resetStream(st, FLOW_CONTROL_ERROR)
+	}
+}
+
+// initialWindowSize applies SETTINGS_INITIAL_WINDOW_SIZE to new streams, and
+// the difference to the open ones.
+func (se *SpdySession) initialWindowSize(size uint32) {
+	se.streamLock.Lock()
+	defer se.streamLock.Unlock()
+
+	delta := int64(size) - se.initialSendWindow
+	se.initialSendWindow = int64(size)
+
+	se.Logger.Debug("Initial send window size %d, delta %d", size, delta)
+	for _, st := range se.streams {
+		if st.sendWindow != nil {
+			st.sendWindow.add(delta)
+		}
+	}
+}
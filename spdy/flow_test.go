@@ -0,0 +1,206 @@
+package spdy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindowWaitsForUpdate(t *testing.T) {
+	w := newWindow(10)
+	if n := w.take(20); n != 10 {
+		t.Fatalf("took %d of a window of 10", n)
+	}
+
+	took := make(chan int64)
+	go func() {
+		took <- w.take(5)
+	}()
+	select {
+	case n := <-took:
+		t.Fatalf("took %d of a used up window", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.add(3)
+	if n := <-took; n != 3 {
+		t.Errorf("took %d after an update of 3", n)
+	}
+
+	go func() {
+		took <- w.take(5)
+	}()
+	w.close()
+	if n := <-took; n != 0 {
+		t.Errorf("took %d of a closed window", n)
+	}
+}
+
+// The bytes the session window can not afford are given back to the stream
+// window.
+func TestTakeWindowsSessionLimited(t *testing.T) {
+	stream, session := newWindow(1000), newWindow(100)
+	if n := takeWindows(stream, session, 500); n != 100 {
+		t.Errorf("took %d, want the 100 of the session", n)
+	}
+	if stream.size != 900 || session.size != 0 {
+		t.Errorf("stream window %d, session window %d, want 900 and 0", stream.size, session.size)
+	}
+}
+
+// A body larger than the session window is sent as the session window
+// opens, the stream window keeps what is not sent.
+func TestSendDataSessionLimited(t *testing.T) {
+	output := newScheduler()
+	pushSyn(output, 1, 0)
+	popNames(t, output, 1)
+
+	st := NewStream(1)
+	st.session = &SpdySession{sendWindow: newWindow(100)}
+	st.sendWindow = newWindow(1000)
+
+	sent := make(chan bool)
+	go func() {
+		sent <- st.sendData(output, []byte(strings.Repeat("x", 1000)), true)
+	}()
+	go func() {
+		for {
+			f, ok := output.pop()
+			if !ok {
+				return
+			}
+			// the peer only opens the session window
+			st.session.sendWindow.add(int64(f.(*DataFrame).Length))
+		}
+	}()
+	defer output.close()
+
+	select {
+	case ok := <-sent:
+		if !ok {
+			t.Error("body not sent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("body stalls with the stream window open")
+	}
+}
+
+// A request body stops at the end of the stream window, and resumes once the
+// server sends WINDOW_UPDATE.
+func TestStreamWindowExhaustionAndResume(t *testing.T) {
+	body := strings.Repeat("x", DEFAULT_WINDOW_SIZE+1000)
+	frames := make(chan Frame, 100)
+	server := make(chan *Framer, 1)
+	c := fakeServerClient(t, func(framer *Framer) {
+		server <- framer
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+		}
+	})
+
+	req, _ := http.NewRequest("POST", "http://origin.test/", strings.NewReader(body))
+	if _, err := c.Request(req, func(uint32, *http.Response, error) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// read waits for the DataFrames of n bytes, and returns the stream id
+	// and FLAG_FIN of the last one
+	read := func(n int) (streamId uint32, fin bool) {
+		for n > 0 {
+			select {
+			case f, ok := <-frames:
+				if !ok {
+					t.Fatal("connection closed")
+				}
+				if dat, ok := f.(*DataFrame); ok {
+					n -= int(dat.Length)
+					streamId, fin = dat.StreamId, dat.Flags&FLAG_FIN != 0
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%d bytes of the body not sent", n)
+			}
+		}
+		return streamId, fin
+	}
+
+	streamId, _ := read(DEFAULT_WINDOW_SIZE)
+	select {
+	case f := <-frames:
+		t.Fatalf("sent %v beyond the stream window", f)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	(<-server).WriteFrame(NewWindowUpdateFrame(streamId, 1000))
+	if _, fin := read(1000); !fin {
+		t.Error("last DataFrame without FLAG_FIN")
+	}
+}
+
+// Reading the response body sends WINDOW_UPDATE once half of the receive
+// window is consumed.
+func TestWindowUpdateAsBodyIsRead(t *testing.T) {
+	size := DEFAULT_WINDOW_SIZE/2 + 1000
+	updates := make(chan *WindowUpdateFrame, 10)
+	c := fakeServerClient(t, func(framer *Framer) {
+		syn := readSyn(t, framer)
+		if syn == nil {
+			return
+		}
+		reply := NewSynReplyFrame(syn.StreamId)
+		reply.Header = map[string]string{":status": "200", ":version": "HTTP/1.1"}
+		framer.WriteFrame(reply)
+		framer.WriteFrame(newTestData(syn.StreamId, strings.Repeat("x", size), 0))
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if wu, ok := f.(*WindowUpdateFrame); ok {
+				updates <- wu
+			}
+		}
+	})
+
+	bodies := make(chan io.Reader, 1)
+	req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+	_, err := c.Request(req, func(_ uint32, res *http.Response, err error) {
+		if err != nil {
+			t.Error(err)
+			close(bodies)
+			return
+		}
+		bodies <- res.Body
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := <-bodies
+	if body == nil {
+		return
+	}
+
+	select {
+	case wu := <-updates:
+		t.Fatalf("%v before the body is read", wu)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := io.ReadFull(body, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case wu := <-updates:
+		if wu.StreamId != 1 || wu.DeltaWindowSize < DEFAULT_WINDOW_SIZE/2 {
+			t.Errorf("%v, want at least %d for Stream#1", wu, DEFAULT_WINDOW_SIZE/2)
+		}
+	case <-time.After(time.Second):
+		t.Error("no WINDOW_UPDATE as the body is read")
+	}
+}
@@ -0,0 +1,301 @@
+package spdy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// ErrUnknownFrame is returned by ReadFrame for a control frame of unknown
+// type. The frame is consumed, spdy asks to ignore it and read on.
+var ErrUnknownFrame = errors.New("unknown CtrlFrame Type")
+
+// MAX_HEADER_LENGTH bounds a name or value of a decompressed header block.
+const MAX_HEADER_LENGTH = 0xffffff
+
+// Framer reads and writes the frames of a spdy connection. Header blocks are
+// compressed with one zlib context for each direction through the whole
+// connection, the Framer owns both, so every frame of the connection must go
+// through it. ReadFrame and WriteFrame may be called from different
+// goroutines.
+type Framer struct {
+	Version uint16
+
+	// Logger of the frames read and written, the package logger by
+	// default.
+	Logger *Logger
+
+	r  io.Reader
+	lr *io.LimitedReader
+	zr io.ReadCloser
+
+	wlock sync.Mutex
+	w     io.Writer
+	buf   *bytes.Buffer
+	zw    *zlib.Writer
+}
+
+func NewFramer(w io.Writer, r io.Reader, version uint16) (*Framer, error) {
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported spdy version %d", version)
+	}
+
+	f := &Framer{
+		Version: version,
+		Logger:  log,
+		r:       r,
+		w:       w,
+		buf:     new(bytes.Buffer),
+	}
+
+	var err error
+	f.zw, err = zlib.NewWriterLevelDict(f.buf, zlib.BestCompression, headerDict(version))
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ReadFrame reads the next frame. Control frames of another version than the
+// Framer's, and frames too short for their type, are errors.
+func (f *Framer) ReadFrame() (Frame, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(f.r, head[:]); err != nil {
+		return nil, err
+	}
+	headFirst := binary.BigEndian.Uint32(head[0:4])
+	flagsLength := binary.BigEndian.Uint32(head[4:8])
+
+	f.Logger.Debug("Receive head from Session: %08x", headFirst)
+
+	// the payload grows as it is read, a Length the peer does not send is
+	// not allocated
+	length := int64(flagsLength & 0xffffff)
+	payload, err := ioutil.ReadAll(io.LimitReader(f.r, length))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if headFirst&0x80000000 == 0 {
+		return f.readDataFrame(headFirst, flagsLength, payload)
+	}
+	return f.readCtrlFrame(headFirst, flagsLength, payload)
+}
+
+func (f *Framer) readDataFrame(headFirst, flagsLength uint32, payload []byte) (Frame, error) {
+	frame := &DataFrame{
+		StreamId: headFirst & 0x7fffffff,
+		Flags:    uint8(flagsLength >> 24),
+		Length:   flagsLength & 0xffffff,
+		Data:     bytes.NewBuffer(payload),
+	}
+
+	if frame.StreamId == 0 {
+		return nil, errors.New("DataFrame StreamId must not 0")
+	}
+
+	f.Logger.Trace("Parse Data Frame, length=%d", frame.Length)
+	return frame, nil
+}
+
+func (f *Framer) readCtrlFrame(headFirst, flagsLength uint32, payload []byte) (Frame, error) {
+	head := CtrlFrameHead{
+		Version: uint16(headFirst & 0x7fff0000 >> 16),
+		Type:    uint16(headFirst & 0xffff),
+		Flags:   uint8(flagsLength >> 24),
+		Length:  flagsLength & 0xffffff,
+	}
+
+	if head.Version != f.Version {
+		return nil, fmt.Errorf("CtrlFrame Version %d mismatch session Version %d", head.Version, f.Version)
+	}
+
+	short := func(min uint32) error {
+		if head.Length < min {
+			return fmt.Errorf("CtrlFrame Type %d Length %d is too short", head.Type, head.Length)
+		}
+		return nil
+	}
+	r := bytes.NewReader(payload)
+
+	switch head.Type {
+	case SYN_STREAM:
+		if err := short(10); err != nil {
+			return nil, err
+		}
+		syn := &SynStreamFrame{CtrlFrameHead: head}
+		syn.Read(r)
+		if err := syn.ReadHeader(f.headerReader(payload[10:]), f.Logger); err != nil {
+			return nil, err
+		}
+		return syn, nil
+	case SYN_REPLY:
+		n := streamHeadLength(f.Version)
+		if err := short(n); err != nil {
+			return nil, err
+		}
+		reply := &SynReplyFrame{CtrlFrameHead: head}
+		reply.Read(r)
+		if err := reply.ReadHeader(f.headerReader(payload[n:]), f.Logger); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	case RST_STREAM:
+		if err := short(8); err != nil {
+			return nil, err
+		}
+		rst := &RstStreamFrame{CtrlFrameHead: head}
+		rst.Read(r)
+		f.Logger.Debug("Receive %v", rst)
+		return rst, nil
+	case SETTINGS:
+		if err := short(4); err != nil {
+			return nil, err
+		}
+		number := binary.BigEndian.Uint32(payload)
+		if uint64(head.Length) < 4+8*uint64(number) {
+			return nil, fmt.Errorf("SettingsFrame Length %d is too short for %d settings", head.Length, number)
+		}
+		set := &SettingsFrame{CtrlFrameHead: head}
+		set.Read(r)
+		return set, nil
+	case NOOP:
+		return &NoopFrame{CtrlFrameHead: head}, nil
+	case PING:
+		if err := short(4); err != nil {
+			return nil, err
+		}
+		ping := &PingFrame{CtrlFrameHead: head}
+		ping.Read(r)
+		f.Logger.Debug("Receive %v", ping)
+		return ping, nil
+	case GOAWAY:
+		if err := short(goawayLength(f.Version)); err != nil {
+			return nil, err
+		}
+		ga := &GoawayFrame{CtrlFrameHead: head}
+		ga.Read(r)
+		f.Logger.Debug("Receive %v", ga)
+		return ga, nil
+	case HEADERS:
+		n := streamHeadLength(f.Version)
+		if err := short(n); err != nil {
+			return nil, err
+		}
+		headers := &HeadersFrame{CtrlFrameHead: head}
+		headers.Read(r)
+		if err := headers.ReadHeader(f.headerReader(payload[n:]), f.Logger); err != nil {
+			return nil, err
+		}
+		return headers, nil
+	case WINDOW_UPDATE:
+		if err := short(8); err != nil {
+			return nil, err
+		}
+		wu := &WindowUpdateFrame{CtrlFrameHead: head}
+		wu.Read(r)
+		f.Logger.Debug("Receive %v", wu)
+		return wu, nil
+	}
+
+	f.Logger.Warn("Unknown CtrlFrame Type %d, ignore it", head.Type)
+	return nil, ErrUnknownFrame
+}
+
+// headerReader feeds a compressed header block to the zlib context of the
+// read direction.
+func (f *Framer) headerReader(block []byte) io.Reader {
+	if f.zr == nil {
+		f.Logger.Debug("init BufferWrapper length=%d", len(block))
+		lr := &io.LimitedReader{R: bytes.NewReader(block), N: int64(len(block))}
+
+		zr, err := zlib.NewReaderDict(lr, headerDict(f.Version))
+		if err != nil {
+			return errReader{err}
+		}
+		f.lr, f.zr = lr, zr
+	} else {
+		f.Logger.Debug("Chang LimitedReader length to %d", len(block))
+		f.lr.R = bytes.NewReader(block)
+		f.lr.N = int64(len(block))
+	}
+	return f.zr
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// streamHeadLength is the length of the fields before the header block of
+// SYN_REPLY and HEADERS, spdy/3 dropped the 16 bits unused field.
+func streamHeadLength(version uint16) uint32 {
+	if version >= 3 {
+		return 4
+	}
+	return 6
+}
+
+// goawayLength is the length of GOAWAY, spdy/3 added the status code.
+func goawayLength(version uint16) uint32 {
+	if version >= 3 {
+		return 8
+	}
+	return 4
+}
+
+// WriteFrame writes frame in the Framer's version, the Version of a control
+// frame is set to it.
+func (f *Framer) WriteFrame(frame Frame) error {
+	f.wlock.Lock()
+	defer f.wlock.Unlock()
+
+	if cf, ok := frame.(ctrlFrame); ok {
+		cf.ctrlHead().Version = f.Version
+	}
+
+	if err := f.writeFrame(frame); err != nil {
+		return err
+	}
+	f.Logger.Debug("Send %v", frame)
+	return nil
+}
+
+func (f *Framer) writeFrame(frame Frame) error {
+	switch frame := frame.(type) {
+	case *DataFrame:
+		return frame.write(f.w)
+	case *SynStreamFrame:
+		return frame.write(f.w, f.buf, f.zw)
+	case *SynReplyFrame:
+		return frame.write(f.w, f.buf, f.zw)
+	case *RstStreamFrame:
+		return frame.write(f.w)
+	case *SettingsFrame:
+		return frame.write(f.w)
+	case *NoopFrame:
+		return frame.write(f.w)
+	case *PingFrame:
+		return frame.write(f.w)
+	case *GoawayFrame:
+		return frame.write(f.w)
+	case *HeadersFrame:
+		return frame.write(f.w, f.buf, f.zw)
+	case *WindowUpdateFrame:
+		return frame.write(f.w)
+	}
+
+	return fmt.Errorf("unknown frame %T", frame)
+}
@@ -0,0 +1,147 @@
+package spdy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testFrames are frames of every type, with the fields version carries.
+func testFrames(version uint16) []Frame {
+	syn := NewSynStreamFrame(1)
+	syn.Flags = FLAG_FIN
+	syn.Priority = 3
+	syn.Header = map[string]string{":method": "GET", ":path": "/", "accept": "a\x00b"}
+	push := NewSynStreamFrame(2)
+	push.Flags = FLAG_UNIDIRECTIONAL
+	push.AssociatedId = 1
+	push.Header = map[string]string{":path": "/style.css"}
+	if version >= 3 {
+		syn.Priority = 7
+		syn.Slot = 2
+	}
+
+	reply := NewSynReplyFrame(1)
+	reply.Header = map[string]string{":status": "200 OK", "content-type": "text/plain"}
+
+	headers := NewHeadersFrame(1)
+	headers.Flags = FLAG_FIN
+	headers.Header = map[string]string{"x-trailer": "done"}
+
+	goaway := NewGoawayFrame(5, 0)
+	if version >= 3 {
+		goaway.Status = GOAWAY_PROTOCOL_ERROR
+	}
+
+	return []Frame{
+		syn,
+		push,
+		reply,
+		newTestData(1, "hello", 0),
+		newTestData(1, "", FLAG_FIN),
+		NewRstStreamFrame(3, CANCEL),
+		NewSettingsFrame([]Setting{
+			{SETTINGS_MAX_CONCURRENT_STREAMS, FLAG_SETTINGS_PERSIST_VALUE, 100},
+			{SETTINGS_INITIAL_WINDOW_SIZE, 0, 1 << 20},
+		}),
+		NewNoopFrame(),
+		NewPingFrame(7),
+		goaway,
+		headers,
+		NewWindowUpdateFrame(1, 1000),
+		// a second header block reuses the zlib contexts of both sides
+		reply,
+	}
+}
+
+func newTestData(streamId uint32, data string, flags uint8) *DataFrame {
+	dat := NewDataFrame(streamId)
+	dat.Flags = flags
+	dat.Data = bytes.NewBufferString(data)
+	dat.Length = uint32(len(data))
+	return dat
+}
+
+// frameValue is what a frame reads as, with the payload of a DataFrame and
+// without the Version and Length of a control frame head, which WriteFrame
+// sets.
+func frameValue(f Frame) interface{} {
+	switch f := f.(type) {
+	case *DataFrame:
+		return [3]interface{}{f.StreamId, f.Flags, f.Data.String()}
+	case ctrlFrame:
+		v := reflect.ValueOf(f).Elem()
+		copy := reflect.New(v.Type()).Elem()
+		copy.Set(v)
+		head := copy.Addr().Interface().(ctrlFrame).ctrlHead()
+		head.Version, head.Length = 0, 0
+		return copy.Interface()
+	}
+	return f
+}
+
+func TestFramerRoundTrip(t *testing.T) {
+	for _, version := range []uint16{2, 3} {
+		var conn bytes.Buffer
+		w, err := NewFramer(&conn, nil, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewFramer(nil, &conn, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frames := testFrames(version)
+		var want []interface{}
+		for _, f := range frames {
+			// the payload of a DataFrame is consumed as it is written
+			want = append(want, frameValue(f))
+			if err := w.WriteFrame(f); err != nil {
+				t.Fatalf("spdy/%d write %v: %v", version, f, err)
+			}
+		}
+
+		for i, f := range frames {
+			got, err := r.ReadFrame()
+			if err != nil {
+				t.Fatalf("spdy/%d read %v: %v", version, f, err)
+			}
+			if cf, ok := got.(ctrlFrame); ok && cf.ctrlHead().Version != version {
+				t.Errorf("spdy/%d read %v of version %d", version, got, cf.ctrlHead().Version)
+			}
+			if w := want[i]; !reflect.DeepEqual(frameValue(got), w) {
+				t.Errorf("spdy/%d read %+v, want %+v", version, frameValue(got), w)
+			}
+		}
+		if conn.Len() != 0 {
+			t.Errorf("spdy/%d %d bytes left", version, conn.Len())
+		}
+	}
+}
+
+func TestFramerVersionMismatch(t *testing.T) {
+	var conn bytes.Buffer
+	w, _ := NewFramer(&conn, nil, 3)
+	r, _ := NewFramer(nil, &conn, 2)
+	w.WriteFrame(NewPingFrame(1))
+	if _, err := r.ReadFrame(); err == nil {
+		t.Error("spdy/2 Framer read a spdy/3 frame")
+	}
+}
+
+func TestFramerUnknownFrame(t *testing.T) {
+	conn := bytes.NewBuffer([]byte{0x80, 3, 0, 0xff, 0, 0, 0, 2, 1, 2})
+	w, _ := NewFramer(conn, nil, 3)
+	w.WriteFrame(NewPingFrame(1))
+
+	r, _ := NewFramer(nil, conn, 3)
+	if _, err := r.ReadFrame(); err != ErrUnknownFrame {
+		t.Fatalf("err = %v, want ErrUnknownFrame", err)
+	}
+	// the unknown frame is consumed, the next one is read
+	f, err := r.ReadFrame()
+	if ping, ok := f.(*PingFrame); err != nil || !ok || ping.PingId != 1 {
+		t.Errorf("read %v, %v after an unknown frame, want the ping", f, err)
+	}
+}
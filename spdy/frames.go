@@ -16,12 +16,49 @@ const (
 	PING
 	GOAWAY
 	HEADERS
+	WINDOW_UPDATE
 )
 const (
 	FLAG_FIN            uint8 = 0x01
 	FLAG_UNIDIRECTIONAL       = 0x02
 )
 
+// RST_STREAM status codes
+const (
+	PROTOCOL_ERROR uint32 = iota + 1
+	INVALID_STREAM
+	REFUSED_STREAM
+	UNSUPPORTED_VERSION
+	CANCEL
+	INTERNAL_ERROR
+	FLOW_CONTROL_ERROR
+	STREAM_IN_USE
+	STREAM_ALREADY_CLOSED
+	INVALID_CREDENTIALS
+	FRAME_TOO_LARGE
+)
+
+var statusNames = map[uint32]string{
+	PROTOCOL_ERROR:        "PROTOCOL_ERROR",
+	INVALID_STREAM:        "INVALID_STREAM",
+	REFUSED_STREAM:        "REFUSED_STREAM",
+	UNSUPPORTED_VERSION:   "UNSUPPORTED_VERSION",
+	CANCEL:                "CANCEL",
+	INTERNAL_ERROR:        "INTERNAL_ERROR",
+	FLOW_CONTROL_ERROR:    "FLOW_CONTROL_ERROR",
+	STREAM_IN_USE:         "STREAM_IN_USE",
+	STREAM_ALREADY_CLOSED: "STREAM_ALREADY_CLOSED",
+	INVALID_CREDENTIALS:   "INVALID_CREDENTIALS",
+	FRAME_TOO_LARGE:       "FRAME_TOO_LARGE",
+}
+
+func StatusName(status uint32) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_STATUS(%d)", status)
+}
+
 type Frame interface {
 	Len() uint32
 }
@@ -51,6 +88,16 @@ func (h *CtrlFrameHead) Len() uint32 {
 	return h.Length
 }
 
+func (h *CtrlFrameHead) ctrlHead() *CtrlFrameHead {
+	return h
+}
+
+// ctrlFrame is implemented by every control frame through CtrlFrameHead.
+type ctrlFrame interface {
+	Frame
+	ctrlHead() *CtrlFrameHead
+}
+
 func (h *CtrlFrameHead) Head() string {
 	return fmt.Sprintf("CtrlFrameHead{Version=%d, Type=%d, Flags=%d, Length=%d}",
 		h.Version, h.Type, h.Flags, h.Length)
@@ -69,6 +116,14 @@ Data frames
 +----------------------------------+
 
 */
+
+// MAX_DATA_LENGTH is the largest Length the 24 bits of a DataFrame hold.
+const MAX_DATA_LENGTH = 0xffffff
+
+// DEFAULT_DATA_FRAME_SIZE is how much of a request body a DataFrame carries
+// unless the session is told otherwise.
+const DEFAULT_DATA_FRAME_SIZE = 16 * 1024
+
 type DataFrame struct {
 	StreamId uint32
 	Flags    uint8
@@ -117,9 +172,18 @@ SYN_STREAM
 |             ...                  |
 +----------------------------------+
 
+spdy/3 takes 3 bits for priority, and the last 8 bits of the unused field
+for the credential slot:
+
++----------------------------------+
+|Pri(3)|Unused(5)|Slot(8)|         |
++------------------------+         |
+
 
 Name/Value header block format
 
+spdy/3 uses int32 instead of int16 for the number and the lengths.
+
 
 +------------------------------------+
 | Number of Name/Value pairs (int16) |
@@ -140,8 +204,9 @@ type SynStreamFrame struct {
 	CtrlFrameHead
 
 	StreamId     uint32
-	AssociatedId uint32
-	Priority     uint16 // Priority: A 2-bit priority field
+	AssociatedId uint32 // Stream pushed by server is associated to a client stream
+	Priority     uint16 // Priority: A 2-bit priority field, 3-bit in spdy/3
+	Slot         uint8  // Credential slot, spdy/3 only
 
 	Header map[string]string
 }
@@ -166,7 +231,7 @@ func (syn *SynStreamFrame) String() string {
 		"Ctrl: true, Version: %d, Type: %d, Flags: %d, Length: %d, "+
 		"StreamId: %d, AssociatedId: %d, Priority: %d, Header: %v }",
 		syn.Version, syn.Type, syn.Flags, syn.Length, syn.StreamId,
-		syn.AssociatedId, syn.Priority<<14, syn.Header)
+		syn.AssociatedId, syn.Priority, syn.Header)
 }
 
 /*
@@ -195,6 +260,24 @@ type SynReplyFrame struct {
 	Header map[string]string
 }
 
+func NewSynReplyFrame(streamId uint32) *SynReplyFrame {
+	frame := &SynReplyFrame{
+		CtrlFrameHead: CtrlFrameHead{
+			Version: Version,
+			Type:    SYN_REPLY,
+		},
+		StreamId: streamId,
+		Header:   make(map[string]string),
+	}
+
+	return frame
+}
+
+func (reply *SynReplyFrame) String() string {
+	return fmt.Sprintf("SynReplyFrame{Flags: %d, StreamId: %d, Header: %v}",
+		reply.Flags, reply.StreamId, reply.Header)
+}
+
 /*
 
 RST_STREAM
@@ -215,6 +298,25 @@ type RstStreamFrame struct {
 	Status   uint32
 }
 
+func NewRstStreamFrame(streamId, status uint32) *RstStreamFrame {
+	frame := &RstStreamFrame{
+		CtrlFrameHead: CtrlFrameHead{
+			Version: Version,
+			Type:    RST_STREAM,
+			Length:  8,
+		},
+		StreamId: streamId,
+		Status:   status,
+	}
+
+	return frame
+}
+
+func (rst *RstStreamFrame) String() string {
+	return fmt.Sprintf("RstStreamFrame{StreamId: %d, Status: %s}",
+		rst.StreamId, StatusName(rst.Status))
+}
+
 /*
 
 SETTINGS
@@ -250,6 +352,63 @@ type Setting struct {
 	Value uint32
 }
 
+// SETTINGS frame flag, the client drops the settings it persisted
+const FLAG_SETTINGS_CLEAR_SETTINGS uint8 = 0x01
+
+// ID_Flags
+const (
+	FLAG_SETTINGS_PERSIST_VALUE uint8 = 0x01 // server asks the client to persist the value
+	FLAG_SETTINGS_PERSISTED     uint8 = 0x02 // client sends back a persisted value
+)
+
+func NewSettingsFrame(settings []Setting) *SettingsFrame {
+	frame := &SettingsFrame{
+		CtrlFrameHead: CtrlFrameHead{
+			Version: Version,
+			Type:    SETTINGS,
+			Length:  uint32(4 + 8*len(settings)),
+		},
+		Settings: settings,
+	}
+
+	return frame
+}
+
+func (set *SettingsFrame) String() string {
+	return fmt.Sprintf("SettingsFrame{Flags: %d, Settings: %v}", set.Flags, set.Settings)
+}
+
+// SETTINGS ids
+const (
+	SETTINGS_UPLOAD_BANDWIDTH uint32 = iota + 1
+	SETTINGS_DOWNLOAD_BANDWIDTH
+	SETTINGS_ROUND_TRIP_TIME
+	SETTINGS_MAX_CONCURRENT_STREAMS
+	SETTINGS_CURRENT_CWND
+	SETTINGS_DOWNLOAD_RETRANS_RATE
+	SETTINGS_INITIAL_WINDOW_SIZE
+	SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE
+)
+
+var settingNames = map[uint32]string{
+	SETTINGS_UPLOAD_BANDWIDTH:               "UPLOAD_BANDWIDTH",
+	SETTINGS_DOWNLOAD_BANDWIDTH:             "DOWNLOAD_BANDWIDTH",
+	SETTINGS_ROUND_TRIP_TIME:                "ROUND_TRIP_TIME",
+	SETTINGS_MAX_CONCURRENT_STREAMS:         "MAX_CONCURRENT_STREAMS",
+	SETTINGS_CURRENT_CWND:                   "CURRENT_CWND",
+	SETTINGS_DOWNLOAD_RETRANS_RATE:          "DOWNLOAD_RETRANS_RATE",
+	SETTINGS_INITIAL_WINDOW_SIZE:            "INITIAL_WINDOW_SIZE",
+	SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE: "CLIENT_CERTIFICATE_VECTOR_SIZE",
+}
+
+func (s Setting) String() string {
+	name, ok := settingNames[s.Id]
+	if !ok {
+		name = fmt.Sprintf("UNKNOWN_SETTING(%d)", s.Id)
+	}
+	return fmt.Sprintf("%s=%d(flag %d)", name, s.Value, s.Flag)
+}
+
 /*
 
 NOOP
@@ -265,6 +424,19 @@ type NoopFrame struct {
 	CtrlFrameHead
 }
 
+func NewNoopFrame() *NoopFrame {
+	return &NoopFrame{
+		CtrlFrameHead: CtrlFrameHead{
+			Version: Version,
+			Type:    NOOP,
+		},
+	}
+}
+
+func (noop *NoopFrame) String() string {
+	return "NoopFrame{}"
+}
+
 /*
 
 PING
@@ -284,6 +456,23 @@ type PingFrame struct {
 	PingId uint32
 }
 
+func NewPingFrame(pingId uint32) *PingFrame {
+	frame := &PingFrame{
+		CtrlFrameHead: CtrlFrameHead{
+			Version: Version,
+			Type:    PING,
+			Length:  4,
+		},
+		PingId: pingId,
+	}
+
+	return frame
+}
+
+func (ping *PingFrame) String() string {
+	return fmt.Sprintf("PingFrame{PingId: %d}", ping.PingId)
+}
+
 /*
 
 GOAWAY
@@ -296,12 +485,40 @@ GOAWAY
 +----------------------------------|
 |X|  Last-good-stream-ID (31 bits) |
 +----------------------------------+
+|    Status code (spdy/3 only)     |
++----------------------------------+
 
 */
 type GoawayFrame struct {
 	CtrlFrameHead
 
 	LastGoodId uint32
+	Status     uint32
+}
+
+// GOAWAY status codes of spdy/3
+const (
+	GOAWAY_OK uint32 = iota
+	GOAWAY_PROTOCOL_ERROR
+	GOAWAY_INTERNAL_ERROR
+)
+
+func NewGoawayFrame(lastGoodId, status uint32) *GoawayFrame {
+	frame := &GoawayFrame{
+		CtrlFrameHead: CtrlFrameHead{
+			Version: Version,
+			Type:    GOAWAY,
+			Length:  4,
+		},
+		LastGoodId: lastGoodId,
+		Status:     status,
+	}
+
+	return frame
+}
+
+func (ga *GoawayFrame) String() string {
+	return fmt.Sprintf("GoawayFrame{LastGoodId: %d, Status: %d}", ga.LastGoodId, ga.Status)
 }
 
 /*
@@ -330,6 +547,67 @@ type HeadersFrame struct {
 	Header map[string]string
 }
 
+func NewHeadersFrame(streamId uint32) *HeadersFrame {
+	frame := &HeadersFrame{
+		CtrlFrameHead: CtrlFrameHead{
+			Version: Version,
+			Type:    HEADERS,
+		},
+		StreamId: streamId,
+		Header:   make(map[string]string),
+	}
+
+	return frame
+}
+
+func (h *HeadersFrame) String() string {
+	return fmt.Sprintf("HeadersFrame{Flags: %d, StreamId: %d, Header: %v}",
+		h.Flags, h.StreamId, h.Header)
+}
+
+/*
+
+WINDOW_UPDATE (spdy/3)
+
++----------------------------------+
+|1|       3          |       9     |
++----------------------------------+
+| 0 (flags) |     8 (length)       |
++----------------------------------+
+|X|     Stream-ID (31-bits)        |
++----------------------------------+
+|X|  Delta-Window-Size (31-bits)   |
++----------------------------------+
+
+Stream-ID 0 updates the session window of spdy/3.1.
+
+*/
+type WindowUpdateFrame struct {
+	CtrlFrameHead
+
+	StreamId        uint32
+	DeltaWindowSize uint32
+}
+
+func NewWindowUpdateFrame(streamId, delta uint32) *WindowUpdateFrame {
+	frame := &WindowUpdateFrame{
+		CtrlFrameHead: CtrlFrameHead{
+			Version: 3,
+			Type:    WINDOW_UPDATE,
+			Length:  8,
+		},
+		StreamId:        streamId,
+		DeltaWindowSize: delta,
+	}
+
+	return frame
+}
+
+func (wu *WindowUpdateFrame) String() string {
+	return fmt.Sprintf("WindowUpdateFrame{StreamId: %d, DeltaWindowSize: %d}",
+		wu.StreamId, wu.DeltaWindowSize)
+}
+
 // HeaderDictionary is the dictionary sent to the zlib compressor/decompressor.
 // Even though the specification states there is no null byte at the end, Chrome sends it.
 const HeaderDict = "optionsgetheadpostputdeletetraceacceptaccept-charsetaccept-encodingaccept-" +
@@ -345,3 +623,44 @@ const HeaderDict = "optionsgetheadpostputdeletetraceacceptaccept-charsetaccept-e
 	"pOctNovDecchunkedtext/htmlimage/pngimage/jpgimage/gifapplication/xmlapplic" +
 	"ation/xhtmltext/plainpublicmax-agecharset=iso-8859-1utf-8gzipdeflateHTTP/1" +
 	".1statusversionurl\x00"
+
+// HeaderDictV3 is the zlib dictionary of spdy/3, each word is prefixed with
+// its length, like the name/value header block.
+const HeaderDictV3 = "\x00\x00\x00\x07options\x00\x00\x00\x04head\x00\x00\x00\x04post\x00\x00" +
+	"\x00\x03put\x00\x00\x00\x06delete\x00\x00\x00\x05trace\x00\x00\x00\x06ac" +
+	"cept\x00\x00\x00\x0eaccept-charset\x00\x00\x00\x0faccept-encoding\x00" +
+	"\x00\x00\x0faccept-language\x00\x00\x00\x0daccept-ranges\x00\x00\x00\x03" +
+	"age\x00\x00\x00\x05allow\x00\x00\x00\x0dauthorization\x00\x00\x00\x0dcac" +
+	"he-control\x00\x00\x00\x0aconnection\x00\x00\x00\x0ccontent-base\x00\x00" +
+	"\x00\x10content-encoding\x00\x00\x00\x10content-language\x00\x00\x00\x0e" +
+	"content-length\x00\x00\x00\x10content-location\x00\x00\x00\x0bcontent-md" +
+	"5\x00\x00\x00\x0dcontent-range\x00\x00\x00\x0ccontent-type\x00\x00\x00" +
+	"\x04date\x00\x00\x00\x04etag\x00\x00\x00\x06expect\x00\x00\x00\x07expire" +
+	"s\x00\x00\x00\x04from\x00\x00\x00\x04host\x00\x00\x00\x08if-match\x00" +
+	"\x00\x00\x11if-modified-since\x00\x00\x00\x0dif-none-match\x00\x00\x00" +
+	"\x08if-range\x00\x00\x00\x13if-unmodified-since\x00\x00\x00\x0dlast-modi" +
+	"fied\x00\x00\x00\x08location\x00\x00\x00\x0cmax-forwards\x00\x00\x00\x06" +
+	"pragma\x00\x00\x00\x12proxy-authenticate\x00\x00\x00\x13proxy-authorizat" +
+	"ion\x00\x00\x00\x05range\x00\x00\x00\x07referer\x00\x00\x00\x0bretry-aft" +
+	"er\x00\x00\x00\x06server\x00\x00\x00\x02te\x00\x00\x00\x07trailer\x00" +
+	"\x00\x00\x11transfer-encoding\x00\x00\x00\x07upgrade\x00\x00\x00\x0auser" +
+	"-agent\x00\x00\x00\x04vary\x00\x00\x00\x03via\x00\x00\x00\x07warning\x00" +
+	"\x00\x00\x10www-authenticate\x00\x00\x00\x06method\x00\x00\x00\x03get" +
+	"\x00\x00\x00\x06status\x00\x00\x00\x06200 OK\x00\x00\x00\x07version\x00" +
+	"\x00\x00\x08HTTP/1.1\x00\x00\x00\x03url\x00\x00\x00\x06public\x00\x00" +
+	"\x00\x0aset-cookie\x00\x00\x00\x0akeep-alive\x00\x00\x00\x06origin100101" +
+	"201202205206300302303304305306307402405406407408409410411412413414415416" +
+	"417502504505203 Non-Authoritative Information204 No Content301 Moved Per" +
+	"manently400 Bad Request401 Unauthorized403 Forbidden404 Not Found500 Int" +
+	"ernal Server Error501 Not Implemented503 Service UnavailableJan Feb Mar " +
+	"Apr May Jun Jul Aug Sept Oct Nov Dec 00:00:00 Mon, Tue, Wed, Thu, Fri, S" +
+	"at, Sun, GMTchunked,text/html,image/png,image/jpg,image/gif,application/" +
+	"xml,application/xhtml+xml,text/plain,text/javascript,publicprivatemax-ag" +
+	"e=gzip,deflate,sdchcharset=utf-8charset=iso-8859-1,utf-,*,enq=0."
+
+func headerDict(version uint16) []byte {
+	if version >= 3 {
+		return []byte(HeaderDictV3)
+	}
+	return []byte(HeaderDict)
+}
@@ -0,0 +1,585 @@
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// DEFAULT_HTTP_CONNS bounds the connections of an HttpSession when MaxConns is
+// 0, as browsers do per host.
+const DEFAULT_HTTP_CONNS = 6
+
+var errCallCanceled = errors.New("Request is canceled")
+
+// errBodyClosed breaks the connection of a response body closed before EOF,
+// the rest of the body is not read.
+var errBodyClosed = errors.New("Response body is closed before EOF")
+
+// HttpSession is the HTTP/1.1 fallback to a host, a pool of up to MaxConns
+// keep-alive connections. A request waits for a free connection, or is
+// pipelined behind others when Pipeline allows it, and its response or error
+// is delivered to its Handle by the reader of the connection, which reads the
+// next response once the body is read to EOF or closed. Connections are
+// dialed while requests wait. A connection the server closes, after
+// Connection: close or not, leaves the pool, and the requests waiting for
+// their response on it are sent again on other connections when they can be
+// replayed.
+type HttpSession struct {
+	// Dial opens the connections added to the pool, it only has the
+	// connection of NewHttpSession when Dial is nil.
+	Dial func() (net.Conn, error)
+
+	// MaxConns bounds the connections, DEFAULT_HTTP_CONNS when 0.
+	MaxConns int
+
+	// Pipeline is the number of requests a connection has in flight,
+	// requests are not pipelined when it is 0 or 1. Only GET and HEAD
+	// requests without body are pipelined, and only behind such requests.
+	Pipeline int
+
+	// Logger of the session, the package logger by default.
+	Logger *Logger
+
+	// lock guards the pool and the calls, requests are made from any
+	// goroutine while the readers of the connections answer them. Calls
+	// no connection has taken wait in queue.
+	lock       sync.Mutex
+	conns      []*httpConn
+	dialing    int
+	dialFailed bool
+	queue      []*httpCall
+	calls      map[uint32]*httpCall
+	lastId     uint32
+	serving    bool
+	closed     bool
+}
+
+// httpCall is a request of an HttpSession.
+type httpCall struct {
+	id      uint32
+	req     *http.Request
+	handle  Handle
+	conn    *httpConn // the connection sending it, nil while queued
+	body    *httpBody // the body of the response once it is delivered
+	err     error     // delivered when the call fails
+	retried bool
+	stopCtx func() bool
+}
+
+// httpConn is a connection of the pool. send writes its calls and recv reads
+// their responses in the same order, inflight holds them until their
+// response body is done.
+type httpConn struct {
+	conn     net.Conn
+	writes   chan *httpCall
+	reads    chan *httpCall
+	inflight []*httpCall
+	retired  bool // takes no more calls, the server closes it
+	broken   bool
+}
+
+func NewHttpSession(conn net.Conn) *HttpSession {
+	hs := &HttpSession{
+		calls:  map[uint32]*httpCall{},
+		Logger: log,
+	}
+	hs.add(conn)
+	return hs
+}
+
+// Serve starts the connections of the session.
+func (hs *HttpSession) Serve() {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	hs.serving = true
+	for _, c := range hs.conns {
+		hs.start(c)
+	}
+	hs.schedule()
+}
+
+// Close closes the connections, and delivers ErrSessionClosed to the
+// requests which have no response yet.
+func (hs *HttpSession) Close() {
+	hs.lock.Lock()
+	hs.closed = true
+	var failed []*httpCall
+	for len(hs.conns) > 0 {
+		failed = append(failed, hs.drop(hs.conns[0], nil)...)
+	}
+	for _, call := range hs.queue {
+		delete(hs.calls, call.id)
+		call.err = ErrSessionClosed
+		failed = append(failed, call)
+	}
+	hs.queue = nil
+	hs.lock.Unlock()
+
+	hs.deliver(failed)
+}
+
+// Request queues req, the response or error is delivered to handle. Calls
+// are numbered from 1 as the stream ids of CancelStream. When req's context
+// is done the call is canceled, and the context's error is delivered to it.
+func (hs *HttpSession) Request(req *http.Request, handle Handle) (uint32, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	if hs.closed || (hs.Dial == nil && len(hs.conns) == 0) {
+		return 0, ErrSessionClosed
+	}
+
+	hs.Logger.Debug("Request %s", req.URL.String())
+
+	hs.lastId++
+	call := &httpCall{id: hs.lastId, req: req, handle: handle}
+	hs.calls[call.id] = call
+	hs.queue = append(hs.queue, call)
+	if ctx := req.Context(); ctx.Done() != nil {
+		call.stopCtx = context.AfterFunc(ctx, func() {
+			hs.cancel(call, ctx.Err())
+		})
+	}
+	hs.schedule()
+
+	return call.id, nil
+}
+
+// CancelStream cancels the call streamId, the connection sending it is
+// closed as HTTP/1.1 can not abort a request otherwise.
+func (hs *HttpSession) CancelStream(streamId uint32) error {
+	hs.lock.Lock()
+	call, ok := hs.calls[streamId]
+	hs.lock.Unlock()
+
+	if !ok || !hs.cancel(call, errCallCanceled) {
+		return errors.New("Request not exist in session")
+	}
+	return nil
+}
+
+// cancel delivers err to call if it is still in the session. A queued call
+// just leaves the queue, otherwise its connection is closed.
+func (hs *HttpSession) cancel(call *httpCall, err error) bool {
+	hs.lock.Lock()
+	if _, ok := hs.calls[call.id]; !ok {
+		hs.lock.Unlock()
+		return false
+	}
+	hs.Logger.Debug("Call#%d canceled: %v", call.id, err)
+
+	call.err = err
+	var failed []*httpCall
+	if call.conn == nil {
+		for i, q := range hs.queue {
+			if q == call {
+				hs.queue = append(hs.queue[:i:i], hs.queue[i+1:]...)
+				break
+			}
+		}
+		delete(hs.calls, call.id)
+		failed = []*httpCall{call}
+	} else {
+		failed = hs.drop(call.conn, err)
+	}
+	hs.schedule()
+	hs.lock.Unlock()
+
+	hs.deliver(failed)
+	return true
+}
+
+// deliver calls the handles of failed calls, without lock held.
+func (hs *HttpSession) deliver(failed []*httpCall) {
+	for _, call := range failed {
+		if call.stopCtx != nil {
+			call.stopCtx()
+		}
+		call.handle(call.id, nil, call.err)
+	}
+}
+
+// replayable tells whether req may be sent again, or pipelined, as it has no
+// side effect the server could have applied already.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD":
+		return (req.Body == nil || req.Body == http.NoBody) && !req.Close
+	}
+	return false
+}
+
+func (hs *HttpSession) depth() int {
+	if hs.Pipeline > 1 {
+		return hs.Pipeline
+	}
+	return 1
+}
+
+func (hs *HttpSession) maxConns() int {
+	if hs.MaxConns > 0 {
+		return hs.MaxConns
+	}
+	return DEFAULT_HTTP_CONNS
+}
+
+// add puts conn in the pool, the caller holds lock.
+func (hs *HttpSession) add(conn net.Conn) {
+	c := &httpConn{conn: conn}
+	hs.conns = append(hs.conns, c)
+	if hs.serving {
+		hs.start(c)
+	}
+}
+
+// start serves c once Pipeline is set, the caller holds lock.
+func (hs *HttpSession) start(c *httpConn) {
+	c.writes = make(chan *httpCall, hs.depth())
+	c.reads = make(chan *httpCall, hs.depth())
+	hs.Logger.Debug("Http connection %s => %s", c.conn.LocalAddr(), c.conn.RemoteAddr())
+	go hs.send(c)
+	go hs.recv(c)
+}
+
+// schedule hands the queued calls to connections which can take them, and
+// dials connections for the calls left, the caller holds lock.
+func (hs *HttpSession) schedule() {
+	if !hs.serving || hs.closed {
+		return
+	}
+
+	for len(hs.queue) > 0 {
+		call := hs.queue[0]
+		c := hs.pick(call)
+		if c == nil {
+			break
+		}
+		hs.queue = hs.queue[1:]
+		call.conn = c
+		c.inflight = append(c.inflight, call)
+		c.writes <- call
+		c.reads <- call
+	}
+
+	for hs.Dial != nil && !hs.dialFailed && hs.dialing < len(hs.queue) &&
+		len(hs.conns)+hs.dialing < hs.maxConns() {
+		hs.dialing++
+		go hs.dial()
+	}
+}
+
+// pick returns the connection to send call on: an idle one, or else the
+// least busy one call can be pipelined on.
+func (hs *HttpSession) pick(call *httpCall) *httpConn {
+	var best *httpConn
+	for _, c := range hs.conns {
+		if len(c.inflight) == 0 {
+			return c
+		}
+		if len(c.inflight) >= hs.depth() || !replayable(call.req) {
+			continue
+		}
+		pipelined := true
+		for _, other := range c.inflight {
+			pipelined = pipelined && replayable(other.req)
+		}
+		if pipelined && (best == nil || len(c.inflight) < len(best.inflight)) {
+			best = c
+		}
+	}
+	return best
+}
+
+// dial adds a connection to the pool. When no connection is left the queued
+// calls get the error, otherwise they wait for the connections there are.
+func (hs *HttpSession) dial() {
+	conn, err := hs.Dial()
+
+	hs.lock.Lock()
+	hs.dialing--
+	var failed []*httpCall
+	if err != nil {
+		hs.Logger.Error("%v", err)
+		hs.dialFailed = true
+		if len(hs.conns) == 0 && hs.dialing == 0 {
+			for _, call := range hs.queue {
+				delete(hs.calls, call.id)
+				call.err = err
+				failed = append(failed, call)
+			}
+			hs.queue = nil
+			hs.dialFailed = false
+		}
+	} else if hs.closed {
+		conn.Close()
+	} else {
+		hs.dialFailed = false
+		hs.add(conn)
+		hs.schedule()
+	}
+	hs.lock.Unlock()
+
+	hs.deliver(failed)
+}
+
+// drop removes c from the pool and closes it. The body of an answered call
+// gets err, and calls waiting for their response are queued again when they
+// can be replayed, otherwise they are returned to be failed. The caller holds
+// lock.
+func (hs *HttpSession) drop(c *httpConn, err error) []*httpCall {
+	if c.broken {
+		return nil
+	}
+	hs.Logger.Debug("Close http connection %s => %s", c.conn.LocalAddr(), c.conn.RemoteAddr())
+
+	c.broken = true
+	hs.remove(c)
+	c.conn.Close()
+	if c.writes != nil {
+		close(c.writes)
+		close(c.reads)
+	}
+
+	var failed, replay []*httpCall
+	for _, call := range c.inflight {
+		switch {
+		case call.body != nil:
+			delete(hs.calls, call.id)
+			if call.err != nil {
+				call.body.finish(call.err)
+			} else {
+				call.body.finish(httpCloseError(err))
+			}
+		case call.err == nil && !call.retried && !hs.closed && replayable(call.req):
+			hs.Logger.Debug("Call#%d is sent again", call.id)
+			call.retried = true
+			call.conn = nil
+			replay = append(replay, call)
+		default:
+			delete(hs.calls, call.id)
+			if call.err == nil {
+				call.err = httpCloseError(err)
+			}
+			failed = append(failed, call)
+		}
+	}
+	c.inflight = nil
+	hs.queue = append(replay, hs.queue...)
+	return failed
+}
+
+// httpCloseError is delivered to the calls of a connection closed after err,
+// nil when the session closes it.
+func httpCloseError(err error) error {
+	if err == nil {
+		return ErrSessionClosed
+	}
+	return closeError(err)
+}
+
+// retire stops c from taking calls once the server said it closes c after
+// the response of call. The calls pipelined behind are queued again, the
+// caller holds lock.
+func (hs *HttpSession) retire(c *httpConn, call *httpCall) {
+	c.retired = true
+	hs.remove(c)
+
+	var replay []*httpCall
+	for _, other := range c.inflight {
+		if other != call {
+			other.conn = nil
+			replay = append(replay, other)
+		}
+	}
+	c.inflight = []*httpCall{call}
+	hs.queue = append(replay, hs.queue...)
+	hs.schedule()
+}
+
+// remove takes c out of the pool, the caller holds lock.
+func (hs *HttpSession) remove(c *httpConn) {
+	for i, other := range hs.conns {
+		if other == c {
+			hs.conns = append(hs.conns[:i:i], hs.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// finish forgets call once its response body is done, the caller holds
+// lock.
+func (hs *HttpSession) finish(c *httpConn, call *httpCall) {
+	for i, other := range c.inflight {
+		if other == call {
+			c.inflight = append(c.inflight[:i:i], c.inflight[i+1:]...)
+			break
+		}
+	}
+	delete(hs.calls, call.id)
+	if call.stopCtx != nil {
+		call.stopCtx()
+	}
+	hs.dialFailed = false
+}
+
+// broken drops c after an I/O error, and fails the calls which can not be
+// sent again.
+func (hs *HttpSession) broken(c *httpConn, err error) {
+	hs.lock.Lock()
+	if !c.broken {
+		hs.Logger.Debug("Http connection %s => %s: %v", c.conn.LocalAddr(), c.conn.RemoteAddr(), err)
+	}
+	failed := hs.drop(c, err)
+	hs.schedule()
+	hs.lock.Unlock()
+
+	hs.deliver(failed)
+}
+
+// owns tells whether call is still sent on c, it is not after being queued
+// again or canceled.
+func (hs *HttpSession) owns(c *httpConn, call *httpCall) bool {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	return call.conn == c && !c.broken && !c.retired
+}
+
+func (hs *HttpSession) send(c *httpConn) {
+	bw := bufio.NewWriter(c.conn)
+	for call := range c.writes {
+		if !hs.owns(c, call) {
+			continue
+		}
+		err := call.req.Write(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			hs.broken(c, err)
+			return
+		}
+	}
+}
+
+func (hs *HttpSession) recv(c *httpConn) {
+	br := bufio.NewReader(c.conn)
+	for call := range c.reads {
+		res, err := http.ReadResponse(br, call.req)
+		if err != nil {
+			hs.broken(c, err)
+			return
+		}
+
+		hs.lock.Lock()
+		if call.conn != c || c.broken {
+			hs.lock.Unlock()
+			return
+		}
+		var body *httpBody
+		if res.Body != http.NoBody {
+			body = newHttpBody(res.Body)
+			res.Body = body
+			call.body = body
+		}
+		if res.Close {
+			hs.Logger.Debug("Call#%d: the server closes the connection", call.id)
+			hs.retire(c, call)
+		}
+		hs.lock.Unlock()
+
+		call.handle(call.id, res, nil)
+
+		if body != nil {
+			if err := body.wait(); err != nil {
+				hs.broken(c, err)
+				return
+			}
+		}
+
+		hs.lock.Lock()
+		hs.finish(c, call)
+		retired := c.retired
+		var failed []*httpCall
+		if retired {
+			failed = hs.drop(c, nil)
+		}
+		hs.schedule()
+		hs.lock.Unlock()
+
+		if retired {
+			hs.deliver(failed)
+			return
+		}
+	}
+}
+
+// httpBody is a response body of an HttpSession, the connection reads the
+// next response once it is done: read to EOF, closed or failed.
+type httpBody struct {
+	rc   io.ReadCloser
+	lock sync.Mutex
+	done chan bool
+	end  bool
+	err  error
+}
+
+func newHttpBody(rc io.ReadCloser) *httpBody {
+	return &httpBody{rc: rc, done: make(chan bool)}
+}
+
+func (b *httpBody) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	err := b.err
+	b.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := b.rc.Read(p)
+	if err == io.EOF {
+		b.finish(nil)
+	} else if err != nil {
+		b.finish(err)
+		b.lock.Lock()
+		err = b.err
+		b.lock.Unlock()
+	}
+	return n, err
+}
+
+// Close breaks the connection unless the body was read to EOF.
+func (b *httpBody) Close() error {
+	b.finish(errBodyClosed)
+	return nil
+}
+
+// finish marks the body done, with err if it did not reach EOF. Only the
+// first call counts.
+func (b *httpBody) finish(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.end {
+		return
+	}
+	b.end = true
+	b.err = err
+	close(b.done)
+}
+
+// wait blocks until the body is done, nil means the connection can read the
+// next response.
+func (b *httpBody) wait() error {
+	<-b.done
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
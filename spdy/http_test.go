@@ -0,0 +1,229 @@
+package spdy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedServer is an HTTP/1.1 server whose connections are served by
+// serve, with the number of the connection from 1. It records the paths each
+// connection received.
+type scriptedServer struct {
+	l     net.Listener
+	lock  sync.Mutex
+	paths map[int][]string
+}
+
+func newScriptedServer(t *testing.T, serve func(s *scriptedServer, n int, conn net.Conn, br *bufio.Reader)) *scriptedServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &scriptedServer{l: l, paths: map[int][]string{}}
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(n int) {
+				defer conn.Close()
+				serve(s, n, conn, bufio.NewReader(conn))
+			}(n)
+		}
+	}()
+	return s
+}
+
+// read reads a request of connection n and records its path.
+func (s *scriptedServer) read(n int, br *bufio.Reader) (*http.Request, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, req.Body)
+	s.lock.Lock()
+	s.paths[n] = append(s.paths[n], req.URL.Path)
+	s.lock.Unlock()
+	return req, nil
+}
+
+// respond answers with the path of req, closing the connection after it
+// when close is set.
+func respond(conn net.Conn, req *http.Request, close bool) {
+	header := ""
+	if close {
+		header = "Connection: close\r\n"
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n%sContent-Length: %d\r\n\r\n%s", header, len(req.URL.Path), req.URL.Path)
+}
+
+// serveAll answers every request of the connection.
+func (s *scriptedServer) serveAll(n int, conn net.Conn, br *bufio.Reader) {
+	for {
+		req, err := s.read(n, br)
+		if err != nil {
+			return
+		}
+		respond(conn, req, false)
+	}
+}
+
+func (s *scriptedServer) session(t *testing.T, maxConns, pipeline int) *HttpSession {
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", s.l.Addr().String())
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := NewHttpSession(conn)
+	hs.Dial = dial
+	hs.MaxConns = maxConns
+	hs.Pipeline = pipeline
+	hs.Serve()
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+// requestAll sends the requests on hs, and returns the body or error of
+// each by path.
+func requestAll(t *testing.T, hs *HttpSession, reqs ...*http.Request) map[string]string {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	got := map[string]string{}
+	for _, req := range reqs {
+		path := req.URL.Path
+		wg.Add(1)
+		_, err := hs.Request(req, func(_ uint32, res *http.Response, err error) {
+			go func() {
+				defer wg.Done()
+				var result string
+				if err != nil {
+					result = "error: " + err.Error()
+				} else {
+					b, err := io.ReadAll(res.Body)
+					res.Body.Close()
+					result = string(b)
+					if err != nil {
+						result = "error: " + err.Error()
+					}
+				}
+				lock.Lock()
+				got[path] = result
+				lock.Unlock()
+			}()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests not answered")
+	}
+	return got
+}
+
+func newGet(t *testing.T, s *scriptedServer, path string) *http.Request {
+	req, err := http.NewRequest("GET", "http://"+s.l.Addr().String()+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// The requests pipelined behind a response with Connection: close are sent
+// again on a new connection.
+func TestHttpSessionReplayAfterConnectionClose(t *testing.T) {
+	s := newScriptedServer(t, func(s *scriptedServer, n int, conn net.Conn, br *bufio.Reader) {
+		if n > 1 {
+			s.serveAll(n, conn, br)
+			return
+		}
+		var reqs []*http.Request
+		for len(reqs) < 3 {
+			req, err := s.read(n, br)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		respond(conn, reqs[0], true)
+	})
+	hs := s.session(t, 1, 3)
+
+	got := requestAll(t, hs, newGet(t, s, "/1"), newGet(t, s, "/2"), newGet(t, s, "/3"))
+	want := map[string]string{"/1": "/1", "/2": "/2", "/3": "/3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("responses %v, want %v", got, want)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sort.Strings(s.paths[2])
+	if want := []string{"/2", "/3"}; !reflect.DeepEqual(s.paths[2], want) {
+		t.Errorf("second connection received %v, want %v", s.paths[2], want)
+	}
+	if len(s.paths) != 2 {
+		t.Errorf("%d connections, want 2", len(s.paths))
+	}
+}
+
+// A request is sent again once when its connection closes before the
+// response, unless it may have been handled, as a POST with a body.
+func TestHttpSessionReplayAfterUnannouncedClose(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		body   string
+		closed int // connections closed after reading the request
+		ok     bool
+		conns  int
+	}{
+		{"GET", "", 1, true, 2},
+		{"GET twice", "", 2, false, 2},
+		{"POST", "body", 1, false, 1},
+	} {
+		s := newScriptedServer(t, func(s *scriptedServer, n int, conn net.Conn, br *bufio.Reader) {
+			if n > tt.closed {
+				s.serveAll(n, conn, br)
+				return
+			}
+			s.read(n, br)
+		})
+		hs := s.session(t, 1, 0)
+
+		req := newGet(t, s, "/")
+		if tt.body != "" {
+			req, _ = http.NewRequest("POST", req.URL.String(), strings.NewReader(tt.body))
+		}
+		got := requestAll(t, hs, req)["/"]
+		if ok := !strings.HasPrefix(got, "error: "); ok != tt.ok {
+			t.Errorf("%s: got %q, want ok %v", tt.name, got, tt.ok)
+		}
+
+		s.lock.Lock()
+		if len(s.paths) != tt.conns {
+			t.Errorf("%s: sent on %d connections, want %d", tt.name, len(s.paths), tt.conns)
+		}
+		s.lock.Unlock()
+	}
+}
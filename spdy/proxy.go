@@ -0,0 +1,238 @@
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProxyFromEnvironment returns the proxy of target, a scheme://host:port url,
+// from HTTPS_PROXY, HTTP_PROXY and NO_PROXY as http.ProxyFromEnvironment
+// reads them. The proxy may be an http:// url, dialed with CONNECT, or a
+// socks5:// one.
+func ProxyFromEnvironment(target *url.URL) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: target})
+}
+
+// ProxyURL returns a proxy function which always picks proxy.
+func ProxyURL(proxy *url.URL) func(*url.URL) (*url.URL, error) {
+	return func(*url.URL) (*url.URL, error) {
+		return proxy, nil
+	}
+}
+
+// dialProxy opens a tunnel to host through proxy, with CONNECT for http://
+// proxies and the SOCKS5 protocol for socks5:// ones. The handshake with the
+// proxy is abandoned when ctx is done.
+func (c *Client) dialProxy(ctx context.Context, proxy *url.URL, host string) (net.Conn, error) {
+	port := proxy.Port()
+	switch proxy.Scheme {
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	case "socks5", "socks5h":
+		if port == "" {
+			port = "1080"
+		}
+	default:
+		return nil, errors.New("Unsupported proxy scheme: " + proxy.Scheme)
+	}
+
+	if c.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+		defer cancel()
+	}
+
+	conn, err := c.dial(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	// a deadline in the past unblocks the handshake once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	tunnel := conn
+	if proxy.Scheme == "http" {
+		tunnel, err = connectHTTP(conn, proxy, host)
+	} else {
+		err = connectSOCKS5(conn, proxy, host)
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// connectHTTP asks the http proxy on conn for a tunnel to host, with Basic
+// authentication when the proxy url has a user.
+func connectHTTP(conn net.Conn, proxy *url.URL, host string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Proxy %s refused CONNECT %s: %s", proxy.Host, host, res.Status)
+	}
+
+	if r.Buffered() > 0 {
+		// the server spoke first, keep what was read with the response
+		return &bufferedConn{conn, r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what its reader has buffered before the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// SOCKS5 protocol values of RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5PasswordAuth = 2
+	socks5Connect      = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+// connectSOCKS5 asks the SOCKS5 proxy on conn to connect to host, with
+// username and password authentication when the proxy url has a user. The
+// host name is resolved by the proxy.
+func connectSOCKS5(conn net.Conn, proxy *url.URL, host string) error {
+	name, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return errors.New("Bad port of " + host)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if proxy.User != nil {
+		methods = []byte{socks5NoAuth, socks5PasswordAuth}
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("Proxy %s is not SOCKS5", proxy.Host)
+	}
+	switch b[1] {
+	case socks5NoAuth:
+	case socks5PasswordAuth:
+		if proxy.User == nil {
+			return fmt.Errorf("Proxy %s requires a password", proxy.Host)
+		}
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 username or password is too long")
+		}
+		auth := []byte{1, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return fmt.Errorf("Proxy %s rejected the password", proxy.Host)
+		}
+	default:
+		return fmt.Errorf("Proxy %s accepts no offered authentication", proxy.Host)
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(name); ip == nil {
+		if len(name) > 255 {
+			return errors.New("SOCKS5 host name is too long")
+		}
+		req = append(req, socks5Domain, byte(len(name)))
+		req = append(req, name...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address
+	res := make([]byte, 4)
+	if _, err := io.ReadFull(conn, res); err != nil {
+		return err
+	}
+	if res[1] != 0 {
+		return fmt.Errorf("Proxy %s failed to connect %s, reply %d", proxy.Host, host, res[1])
+	}
+	var skip int
+	switch res[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		skip = int(b[0])
+	default:
+		return fmt.Errorf("Proxy %s replied a bad address type %d", proxy.Host, res[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -1,80 +1,175 @@
 package spdy
 
 import (
-	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"strings"
 )
 
+func (frame *SynStreamFrame) Read(r io.Reader) {
+	binary.Read(r, binary.BigEndian, &frame.StreamId)
+	frame.StreamId &= 0x7fffffff
+
+	binary.Read(r, binary.BigEndian, &frame.AssociatedId)
+	frame.AssociatedId &= 0x7fffffff
+
+	var priority uint16
+	binary.Read(r, binary.BigEndian, &priority)
+	if frame.Version >= 3 {
+		frame.Priority = priority >> 13
+		frame.Slot = uint8(priority)
+	} else {
+		frame.Priority = priority >> 14
+	}
+}
+
+func (frame *SynStreamFrame) ReadHeader(zr io.Reader, log *Logger) error {
+	log.Debug("SynStreamFrame(StreamId#%d) header", frame.StreamId)
+	header, err := readHeader(zr, frame.Version, log)
+	frame.Header = header
+	return err
+}
+
 func (frame *SynReplyFrame) Read(r io.Reader) {
 	binary.Read(r, binary.BigEndian, &frame.StreamId)
+	frame.StreamId &= 0x7fffffff
 
-	var unused uint16
-	binary.Read(r, binary.BigEndian, &unused)
+	if frame.Version < 3 {
+		var unused uint16
+		binary.Read(r, binary.BigEndian, &unused)
+	}
 }
 
-func (frame *SynReplyFrame) ReadHeader(zr io.Reader) {
-	var number uint16
-	binary.Read(zr, binary.BigEndian, &number)
-	log.Debug("SynReplyFrame(StreamId#%d) header number %d", frame.StreamId, number)
+func (frame *SynReplyFrame) ReadHeader(zr io.Reader, log *Logger) error {
+	log.Debug("SynReplyFrame(StreamId#%d) header", frame.StreamId)
+	header, err := readHeader(zr, frame.Version, log)
+	frame.Header = header
+	return err
+}
 
-	header := map[string]string{}
+func (frame *HeadersFrame) Read(r io.Reader) {
+	binary.Read(r, binary.BigEndian, &frame.StreamId)
+	frame.StreamId &= 0x7fffffff
 
-	for i := uint16(0); i < number; i++ {
-		var nameLen uint16
-		binary.Read(zr, binary.BigEndian, &nameLen)
+	if frame.Version < 3 {
+		binary.Read(r, binary.BigEndian, &frame.Unused)
+	}
+}
+
+func (frame *HeadersFrame) ReadHeader(zr io.Reader, log *Logger) error {
+	log.Debug("HeadersFrame(StreamId#%d) header", frame.StreamId)
+	header, err := readHeader(zr, frame.Version, log)
+	frame.Header = header
+	return err
+}
 
-		nameBytes := make([]byte, nameLen)
-		io.ReadFull(zr, nameBytes)
-		name := string(nameBytes)
+// readHeader decodes a name/value header block from the session's shared
+// zlib reader. The numbers are int16 in spdy/2 and int32 in spdy/3.
+func readHeader(zr io.Reader, version uint16, log *Logger) (map[string]string, error) {
+	readLen := func() (uint32, error) {
+		if version >= 3 {
+			var n uint32
+			err := binary.Read(zr, binary.BigEndian, &n)
+			return n, err
+		}
+		var n uint16
+		err := binary.Read(zr, binary.BigEndian, &n)
+		return uint32(n), err
+	}
+	readString := func() (string, error) {
+		n, err := readLen()
+		if err != nil {
+			return "", err
+		}
+		if n > MAX_HEADER_LENGTH {
+			return "", fmt.Errorf("header length %d is too large", n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(zr, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	number, err := readLen()
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Header number %d", number)
+
+	header := map[string]string{}
+
+	for i := uint32(0); i < number; i++ {
+		name, err := readString()
+		if err != nil {
+			return nil, err
+		}
 		lowerName := strings.ToLower(name)
 		if name != lowerName {
 			log.Error("unlowercased header name `%v`", name)
 		}
 		name = lowerName
 
-		var valueLen uint16
-		binary.Read(zr, binary.BigEndian, &valueLen)
-
-		valueBytes := make([]byte, valueLen)
-		io.ReadFull(zr, valueBytes)
-		values := string(valueBytes)
+		values, err := readString()
+		if err != nil {
+			return nil, err
+		}
 
 		log.Debug("%-20s %s", name+":", values)
 
 		header[name] = values
 	}
-	frame.Header = header
+	return header, nil
+}
+
+func (frame *RstStreamFrame) Read(r io.Reader) {
+	binary.Read(r, binary.BigEndian, &frame.StreamId)
+	frame.StreamId &= 0x7fffffff
+
+	binary.Read(r, binary.BigEndian, &frame.Status)
 }
 
-func (frame *DataFrame) ReadBody(r io.Reader) (Frame, error) {
-	body := make([]byte, frame.Len())
-	io.ReadFull(r, body)
-	frame.Data = bytes.NewBuffer(body)
+func (frame *PingFrame) Read(r io.Reader) {
+	binary.Read(r, binary.BigEndian, &frame.PingId)
+}
 
-	log.Trace("Parse Data Frame, length=%d", frame.Len())
+func (frame *WindowUpdateFrame) Read(r io.Reader) {
+	binary.Read(r, binary.BigEndian, &frame.StreamId)
+	frame.StreamId &= 0x7fffffff
 
-	return frame, nil
+	binary.Read(r, binary.BigEndian, &frame.DeltaWindowSize)
+	frame.DeltaWindowSize &= 0x7fffffff
 }
 
 func (frame *GoawayFrame) Read(r io.Reader) {
 	var lastId uint32
-	binary.Read(r, binary.LittleEndian, &lastId)
+	binary.Read(r, binary.BigEndian, &lastId)
+	frame.LastGoodId = lastId & 0x7fffffff
 
-	log.Debug("Receive GoawayFrame with last good stream id %d", lastId)
+	if frame.Version >= 3 {
+		binary.Read(r, binary.BigEndian, &frame.Status)
+	}
 }
 
 func (frame *SettingsFrame) Read(r io.Reader) {
 	var number uint32
 	binary.Read(r, binary.BigEndian, &number)
 
-	frame.Settings = make([]Setting, 4)
+	frame.Settings = make([]Setting, number)
 
 	for i := uint32(0); i < number; i++ {
+		var id uint32
+		var flags uint8
 		var idFlag uint32
-		binary.Read(r, binary.LittleEndian, &idFlag)
-		id, flags := idFlag&0x00ffffff, uint8(idFlag>>24)
+		if frame.Version >= 3 {
+			binary.Read(r, binary.BigEndian, &idFlag)
+			id, flags = idFlag&0x00ffffff, uint8(idFlag>>24)
+		} else {
+			// spdy/2 sends the id in little endian, see the Chromium bug
+			binary.Read(r, binary.LittleEndian, &idFlag)
+			id, flags = idFlag&0x00ffffff, uint8(idFlag>>24)
+		}
 
 		var value uint32
 		binary.Read(r, binary.BigEndian, &value)
@@ -0,0 +1,217 @@
+package spdy
+
+import (
+	"sync"
+)
+
+// MAX_QUEUED_DATA is how many DataFrames a stream may queue before the
+// sender waits, so a large body is not read into memory at once.
+const MAX_QUEUED_DATA = 4
+
+// scheduler orders the frames to send. Control frames go first, then
+// SYN_STREAM in stream id order, then the frames of the streams with the
+// highest priority, round robin among streams of equal priority.
+type scheduler struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	closed bool
+	logger *Logger
+
+	control []Frame
+	syn     []*SynStreamFrame
+
+	// frames following SYN_STREAM, by stream, and the streams with queued
+	// frames by priority, 0 is the highest
+	streams  map[uint32][]Frame
+	priority map[uint32]uint16
+	levels   [8][]uint32
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		streams:  map[uint32][]Frame{},
+		priority: map[uint32]uint16{},
+		logger:   log,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// push queues frame, it waits while the stream of a DataFrame has
+// MAX_QUEUED_DATA frames queued. It returns false if the frame is dropped,
+// because the scheduler is closed, the stream is finished, or a RST_STREAM
+// drops the SYN_STREAM of its stream instead.
+func (s *scheduler) push(frame Frame) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		s.logger.Debug("Scheduler closed, drop frame %v", frame)
+		return false
+	}
+
+	switch f := frame.(type) {
+	case *SynStreamFrame:
+		s.priority[f.StreamId] = f.Priority
+		s.syn = append(s.syn, f)
+	case *SynReplyFrame:
+		if f.Flags&FLAG_FIN != 0 {
+			delete(s.priority, f.StreamId)
+		}
+		s.control = append(s.control, f)
+	case *DataFrame:
+		for len(s.streams[f.StreamId]) >= MAX_QUEUED_DATA && !s.closed {
+			s.cond.Wait()
+		}
+		// the stream may be reset while waiting
+		if _, ok := s.priority[f.StreamId]; !ok || s.closed {
+			s.logger.Debug("Stream#%d is finished or reset, drop %v", f.StreamId, f)
+			return false
+		}
+		s.pushStream(f.StreamId, f)
+	case *HeadersFrame:
+		if _, ok := s.priority[f.StreamId]; !ok {
+			s.logger.Debug("Stream#%d is finished or reset, drop %v", f.StreamId, f)
+			return false
+		}
+		s.pushStream(f.StreamId, f)
+	case *RstStreamFrame:
+		// what the stream has queued is useless once it is reset, and a
+		// stream whose SYN_STREAM is still queued is never opened, the
+		// peer would get RST_STREAM for an unknown stream before it
+		s.dropStream(f.StreamId)
+		if s.dropSyn(f.StreamId) {
+			s.logger.Debug("Stream#%d reset before its SYN_STREAM is sent, drop both", f.StreamId)
+			s.cond.Broadcast()
+			return false
+		}
+		s.control = append(s.control, f)
+	default:
+		s.control = append(s.control, frame)
+	}
+
+	s.cond.Broadcast()
+	return true
+}
+
+// open lets the frames of a stream the peer started be queued with its
+// priority, the SYN_STREAM we send does it for ours.
+func (s *scheduler) open(streamId uint32, priority uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.closed {
+		s.priority[streamId] = priority
+	}
+}
+
+// pushStream queues a frame behind the stream's SYN_STREAM, the caller holds
+// the lock.
+func (s *scheduler) pushStream(streamId uint32, frame Frame) {
+	if len(s.streams[streamId]) == 0 {
+		pri := s.priority[streamId]
+		s.levels[pri] = append(s.levels[pri], streamId)
+	}
+	s.streams[streamId] = append(s.streams[streamId], frame)
+}
+
+// dropStream forgets the frames queued by a stream, the caller holds the
+// lock.
+func (s *scheduler) dropStream(streamId uint32) {
+	if len(s.streams[streamId]) > 0 {
+		pri := s.priority[streamId]
+		for i, id := range s.levels[pri] {
+			if id == streamId {
+				s.levels[pri] = append(s.levels[pri][:i], s.levels[pri][i+1:]...)
+				break
+			}
+		}
+	}
+	delete(s.streams, streamId)
+	delete(s.priority, streamId)
+}
+
+// dropSyn forgets the queued SYN_STREAM of a stream, and tells whether there
+// was one, the caller holds the lock.
+func (s *scheduler) dropSyn(streamId uint32) bool {
+	for i, syn := range s.syn {
+		if syn.StreamId == streamId {
+			s.syn = append(s.syn[:i], s.syn[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pop waits for the next frame to send, it returns false once the scheduler
+// is closed.
+func (s *scheduler) pop() (Frame, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		if s.closed {
+			return nil, false
+		}
+
+		if len(s.control) > 0 {
+			frame := s.control[0]
+			s.control = s.control[1:]
+			return frame, true
+		}
+
+		if len(s.syn) > 0 {
+			syn := s.syn[0]
+			s.syn = s.syn[1:]
+			if syn.Flags&FLAG_FIN != 0 {
+				delete(s.priority, syn.StreamId)
+			}
+			return syn, true
+		}
+
+		for pri := range s.levels {
+			if len(s.levels[pri]) == 0 {
+				continue
+			}
+
+			streamId := s.levels[pri][0]
+			frames := s.streams[streamId]
+			frame := frames[0]
+			s.streams[streamId] = frames[1:]
+
+			// the stream goes to the end of its level if it has more
+			s.levels[pri] = s.levels[pri][1:]
+			if len(frames) > 1 {
+				s.levels[pri] = append(s.levels[pri], streamId)
+			} else {
+				delete(s.streams, streamId)
+			}
+			if isFin(frame) {
+				delete(s.priority, streamId)
+			}
+
+			s.cond.Broadcast()
+			return frame, true
+		}
+
+		s.cond.Wait()
+	}
+}
+
+func (s *scheduler) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+func isFin(frame Frame) bool {
+	switch f := frame.(type) {
+	case *DataFrame:
+		return f.Flags&FLAG_FIN != 0
+	case *HeadersFrame:
+		return f.Flags&FLAG_FIN != 0
+	}
+	return false
+}
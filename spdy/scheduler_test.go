@@ -0,0 +1,196 @@
+package spdy
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// frameName is a short name of a queued frame, such as S1 for the
+// SYN_STREAM of Stream#1, D3 for a DataFrame of Stream#3, or P for a ping.
+func frameName(f Frame) string {
+	switch f := f.(type) {
+	case *SynStreamFrame:
+		return fmt.Sprintf("S%d", f.StreamId)
+	case *DataFrame:
+		return fmt.Sprintf("D%d", f.StreamId)
+	case *HeadersFrame:
+		return fmt.Sprintf("H%d", f.StreamId)
+	case *RstStreamFrame:
+		return fmt.Sprintf("R%d", f.StreamId)
+	case *PingFrame:
+		return "P"
+	}
+	return fmt.Sprintf("%T", f)
+}
+
+func popNames(t *testing.T, s *scheduler, n int) []string {
+	var names []string
+	for i := 0; i < n; i++ {
+		f, ok := s.pop()
+		if !ok {
+			t.Fatalf("scheduler closed after %v", names)
+		}
+		names = append(names, frameName(f))
+	}
+	return names
+}
+
+func pushSyn(s *scheduler, streamId uint32, priority uint16) {
+	syn := NewSynStreamFrame(streamId)
+	syn.Priority = priority
+	s.push(syn)
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler()
+	pushSyn(s, 1, 2)
+	pushSyn(s, 3, 0)
+	pushSyn(s, 5, 0)
+	for i := 0; i < 3; i++ {
+		for _, id := range []uint32{1, 3, 5} {
+			s.push(newTestData(id, "x", 0))
+		}
+	}
+	s.push(NewPingFrame(1))
+
+	// control frames first, then SYN_STREAM by stream id, then the data
+	// of priority 0 round robin before the data of priority 2
+	want := []string{"P", "S1", "S3", "S5", "D3", "D5", "D3", "D5", "D3", "D5", "D1", "D1", "D1"}
+	if got := popNames(t, s, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerRoundRobinJoin(t *testing.T) {
+	s := newScheduler()
+	pushSyn(s, 1, 0)
+	pushSyn(s, 3, 0)
+	popNames(t, s, 2)
+
+	s.push(newTestData(1, "x", 0))
+	s.push(newTestData(1, "x", 0))
+	if got := popNames(t, s, 1); got[0] != "D1" {
+		t.Fatalf("sent %v, want D1", got)
+	}
+	// a stream starting to send waits for its turn behind Stream#1
+	s.push(newTestData(3, "x", 0))
+	s.push(newTestData(1, "x", 0))
+	want := []string{"D1", "D3", "D1"}
+	if got := popNames(t, s, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerReset(t *testing.T) {
+	s := newScheduler()
+	pushSyn(s, 1, 0)
+	pushSyn(s, 3, 0)
+	popNames(t, s, 2)
+
+	s.push(newTestData(1, "x", 0))
+	s.push(newTestData(3, "x", 0))
+	s.push(NewRstStreamFrame(1, CANCEL))
+
+	// the frames of the reset stream are dropped, and refused afterwards
+	if s.push(newTestData(1, "x", 0)) {
+		t.Error("DataFrame of a reset stream is queued")
+	}
+	if s.push(NewHeadersFrame(1)) {
+		t.Error("HeadersFrame of a reset stream is queued")
+	}
+	want := []string{"R1", "D3"}
+	if got := popNames(t, s, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+// A stream reset while its SYN_STREAM is queued is never opened, the peer
+// gets neither frame.
+func TestSchedulerResetQueuedSyn(t *testing.T) {
+	s := newScheduler()
+	pushSyn(s, 1, 0)
+	pushSyn(s, 3, 0)
+	if s.push(NewRstStreamFrame(3, CANCEL)) {
+		t.Error("RST_STREAM of a stream not opened is queued")
+	}
+	if s.push(newTestData(3, "x", 0)) {
+		t.Error("DataFrame of a stream not opened is queued")
+	}
+	s.push(NewPingFrame(1))
+
+	want := []string{"P", "S1"}
+	if got := popNames(t, s, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+	s.close()
+	if f, ok := s.pop(); ok {
+		t.Errorf("sent %s of the reset stream", frameName(f))
+	}
+}
+
+func TestSchedulerFinishedStream(t *testing.T) {
+	s := newScheduler()
+	pushSyn(s, 1, 0)
+	s.push(newTestData(1, "x", FLAG_FIN))
+	popNames(t, s, 2)
+
+	if s.push(newTestData(1, "x", 0)) {
+		t.Error("DataFrame after FLAG_FIN is queued")
+	}
+}
+
+func TestSchedulerBoundsQueuedData(t *testing.T) {
+	s := newScheduler()
+	pushSyn(s, 1, 0)
+	popNames(t, s, 1)
+	for i := 0; i < MAX_QUEUED_DATA; i++ {
+		s.push(newTestData(1, "x", 0))
+	}
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- s.push(newTestData(1, "x", 0))
+	}()
+	select {
+	case <-pushed:
+		t.Fatalf("stream queued more than %d DataFrames", MAX_QUEUED_DATA)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	popNames(t, s, 1)
+	select {
+	case ok := <-pushed:
+		if !ok {
+			t.Error("DataFrame dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push blocked after a DataFrame was sent")
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := newScheduler()
+	pushSyn(s, 1, 0)
+	popNames(t, s, 1)
+	for i := 0; i < MAX_QUEUED_DATA; i++ {
+		s.push(newTestData(1, "x", 0))
+	}
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- s.push(newTestData(1, "x", 0))
+	}()
+	s.close()
+
+	if ok := <-pushed; ok {
+		t.Error("DataFrame waiting for the queue is queued after close")
+	}
+	if s.push(NewPingFrame(1)) {
+		t.Error("frame is queued after close")
+	}
+	if f, ok := s.pop(); ok {
+		t.Errorf("pop %v after close", f)
+	}
+}
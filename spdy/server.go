@@ -0,0 +1,936 @@
+package spdy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errStreamClosed = errors.New("Stream is closed")
+
+// Server serves an http.Handler over spdy/3.1, spdy/3 and spdy/2, negotiated
+// on TLS. Clients which negotiate none of them are served HTTP/1.1 by
+// net/http.
+type Server struct {
+	Addr      string
+	Handler   http.Handler // http.DefaultServeMux if nil
+	TLSConfig *tls.Config
+
+	// MaxConcurrentStreams is sent to clients in SETTINGS, streams beyond it
+	// are refused. 0 leaves them unlimited.
+	MaxConcurrentStreams uint32
+
+	// Logger of the connections, the package logger when nil.
+	Logger *Logger
+}
+
+func (srv *Server) logger() *Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return log
+}
+
+// ListenAndServeTLS listens on addr and serves handler over spdy, or over
+// HTTP/1.1 to clients which do not speak spdy.
+func ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) error {
+	srv := &Server{Addr: addr, Handler: handler}
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	hs := &http.Server{Addr: srv.Addr, Handler: srv.Handler}
+	srv.ConfigureServer(hs)
+	return hs.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ConfigureServer makes hs offer the spdy protocols on TLS, and hand the
+// connections negotiating them to srv.
+func (srv *Server) ConfigureServer(hs *http.Server) {
+	if hs.TLSConfig == nil {
+		if srv.TLSConfig != nil {
+			hs.TLSConfig = srv.TLSConfig.Clone()
+		} else {
+			hs.TLSConfig = &tls.Config{}
+		}
+	}
+	hs.TLSConfig.NextProtos = append(append([]string{}, SpdyProtos...), "http/1.1")
+
+	if hs.TLSNextProto == nil {
+		hs.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	for _, proto := range SpdyProtos {
+		proto := proto
+		hs.TLSNextProto[proto] = func(hs *http.Server, conn *tls.Conn, handler http.Handler) {
+			srv.serveConn(conn, proto, handler)
+		}
+	}
+}
+
+// ServeConn serves spdy on conn with proto, such as "spdy/3.1", until the
+// connection is closed. It is for connections the client is known to speak
+// spdy on, TLS connections are handed over by ConfigureServer.
+func (srv *Server) ServeConn(conn net.Conn, proto string) error {
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	return srv.serveConn(conn, proto, handler)
+}
+
+func (srv *Server) serveConn(conn net.Conn, proto string, handler http.Handler) error {
+	defer conn.Close()
+	log := srv.logger()
+
+	version, sessionFlow := protoVersion(proto)
+	framer, err := NewFramer(conn, conn, version)
+	if err != nil {
+		log.Error("%v", err)
+		return err
+	}
+	framer.Logger = log
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sc := &serverConn{
+		srv:               srv,
+		conn:              conn,
+		handler:           handler,
+		ctx:               ctx,
+		version:           version,
+		sessionFlow:       sessionFlow,
+		framer:            framer,
+		output:            newScheduler(),
+		logger:            log,
+		streams:           map[uint32]*serverStream{},
+		initialSendWindow: DEFAULT_WINDOW_SIZE,
+		recvWindow:        newRecvWindow(DEFAULT_WINDOW_SIZE),
+	}
+	if sessionFlow {
+		sc.sendWindow = newWindow(DEFAULT_WINDOW_SIZE)
+	}
+	sc.output.logger = log
+
+	log.Debug("Serve %s from %s", proto, conn.RemoteAddr())
+	return sc.serve()
+}
+
+// serverConn is a spdy connection accepted by Server.
+type serverConn struct {
+	srv         *Server
+	conn        net.Conn
+	handler     http.Handler
+	ctx         context.Context
+	version     uint16
+	sessionFlow bool
+	framer      *Framer
+	output      *scheduler
+	logger      *Logger
+
+	lock              sync.Mutex
+	streams           map[uint32]*serverStream
+	lastInId          uint32
+	lastOutId         uint32
+	initialSendWindow int64
+
+	// sendWindow is the session window of spdy/3.1, nil otherwise
+	sendWindow *window
+	recvWindow *recvWindow
+}
+
+// serverStream is a stream the client started, its request body is fed by
+// DATA and its response is written by the handler.
+type serverStream struct {
+	id       uint32
+	priority uint16
+	req      *http.Request
+	body     *streamBody
+	cancel   context.CancelFunc
+
+	// the windows are nil in spdy/2
+	sendWindow *window
+	recvWindow *recvWindow
+
+	// remoteFin is set when the request is done, localFin when the
+	// response is, the stream is forgotten once both are
+	remoteFin bool
+	localFin  bool
+}
+
+func (sc *serverConn) serve() error {
+	if max := sc.srv.MaxConcurrentStreams; max > 0 {
+		sc.output.push(NewSettingsFrame([]Setting{{SETTINGS_MAX_CONCURRENT_STREAMS, 0, max}}))
+	}
+
+	go sc.send()
+	defer sc.close()
+
+	for {
+		frame, err := sc.framer.ReadFrame()
+		if err == ErrUnknownFrame {
+			continue
+		}
+		if err != nil {
+			if !isClosedConn(err) {
+				sc.logger.Error("%v", err)
+				sc.goaway(GOAWAY_PROTOCOL_ERROR)
+			}
+			return err
+		}
+
+		sc.proc(frame)
+	}
+}
+
+func (sc *serverConn) send() {
+	for {
+		frame, ok := sc.output.pop()
+		if !ok {
+			break
+		}
+
+		if err := sc.framer.WriteFrame(frame); err != nil {
+			sc.logger.Error("%v", err)
+			sc.conn.Close()
+			break
+		}
+	}
+}
+
+// goaway tells the client no more streams are served, it is written at once
+// as the connection is about to close.
+func (sc *serverConn) goaway(status uint32) {
+	sc.lock.Lock()
+	lastInId := sc.lastInId
+	sc.lock.Unlock()
+
+	sc.framer.WriteFrame(NewGoawayFrame(lastInId, status))
+}
+
+// close ends the streams left when the connection is gone.
+func (sc *serverConn) close() {
+	sc.output.close()
+	sc.conn.Close()
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	for id, st := range sc.streams {
+		sc.closeStream(st, errors.New("Connection is closed"))
+		delete(sc.streams, id)
+	}
+}
+
+func isClosedConn(err error) bool {
+	return err == io.EOF || errors.Is(err, net.ErrClosed)
+}
+
+func (sc *serverConn) proc(frame Frame) {
+	switch frame := frame.(type) {
+	case *SynStreamFrame:
+		sc.synStream(frame)
+	case *DataFrame:
+		sc.data(frame)
+	case *HeadersFrame:
+		sc.headers(frame)
+	case *RstStreamFrame:
+		sc.lock.Lock()
+		st, ok := sc.streams[frame.StreamId]
+		if ok {
+			delete(sc.streams, frame.StreamId)
+			sc.closeStream(st, &RstStreamError{StreamId: frame.StreamId, Status: frame.Status})
+		}
+		sc.lock.Unlock()
+	case *SettingsFrame:
+		for _, s := range frame.Settings {
+			sc.logger.Debug("Client %v", s)
+			if s.Id == SETTINGS_INITIAL_WINDOW_SIZE && sc.version >= 3 {
+				sc.initialWindowSize(s.Value)
+			}
+		}
+	case *PingFrame:
+		if frame.PingId%2 == 1 {
+			sc.logger.Debug("Echo client Ping#%d", frame.PingId)
+			sc.output.push(frame)
+		}
+	case *WindowUpdateFrame:
+		sc.windowUpdate(frame)
+	case *GoawayFrame:
+		sc.logger.Debug("Client goes away after Stream#%d", frame.LastGoodId)
+	case *NoopFrame:
+	case *SynReplyFrame:
+		sc.logger.Error("Client sent SYN_REPLY for Stream#%d", frame.StreamId)
+		sc.output.push(NewRstStreamFrame(frame.StreamId, PROTOCOL_ERROR))
+	}
+}
+
+func (sc *serverConn) synStream(syn *SynStreamFrame) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if syn.StreamId%2 == 0 || syn.StreamId <= sc.lastInId {
+		sc.logger.Error("Client Stream#%d must be odd and increasing", syn.StreamId)
+		sc.output.push(NewRstStreamFrame(syn.StreamId, PROTOCOL_ERROR))
+		return
+	}
+	sc.lastInId = syn.StreamId
+
+	if max := sc.srv.MaxConcurrentStreams; max > 0 && uint32(len(sc.streams)) >= max {
+		sc.logger.Debug("Refuse Stream#%d beyond %d concurrent streams", syn.StreamId, max)
+		sc.output.push(NewRstStreamFrame(syn.StreamId, REFUSED_STREAM))
+		return
+	}
+
+	req, err := sc.newRequest(syn)
+	if err != nil {
+		sc.logger.Error("%v", err)
+		sc.output.push(NewRstStreamFrame(syn.StreamId, PROTOCOL_ERROR))
+		return
+	}
+
+	st := &serverStream{
+		id:        syn.StreamId,
+		priority:  syn.Priority,
+		remoteFin: syn.Flags&FLAG_FIN != 0,
+	}
+	if sc.version >= 3 {
+		st.sendWindow = newWindow(sc.initialSendWindow)
+		st.recvWindow = newRecvWindow(DEFAULT_WINDOW_SIZE)
+	}
+	if !st.remoteFin {
+		st.body = newStreamBody(func(n int) { sc.consumed(st, n) })
+		req.Body = &requestBody{st.body}
+	}
+
+	ctx, cancel := context.WithCancel(sc.ctx)
+	st.req, st.cancel = req.WithContext(ctx), cancel
+	sc.streams[st.id] = st
+	sc.output.open(st.id, st.priority)
+
+	go sc.runHandler(&responseWriter{sc: sc, st: st, header: http.Header{}}, st.req)
+}
+
+// newRequest builds the request of a SYN_STREAM, spdy/3 prefixes the request
+// line and host with a colon.
+func (sc *serverConn) newRequest(syn *SynStreamFrame) (*http.Request, error) {
+	prefix, path := "", syn.Header["url"]
+	if sc.version >= 3 {
+		prefix, path = ":", syn.Header[":path"]
+	}
+	method := syn.Header[prefix+"method"]
+	proto := syn.Header[prefix+"version"]
+	host := syn.Header[prefix+"host"]
+	if method == "" || path == "" || proto == "" {
+		return nil, fmt.Errorf("Stream#%d request without method, path or version", syn.StreamId)
+	}
+
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, fmt.Errorf("Stream#%d request with bad path `%s`", syn.StreamId, path)
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, fmt.Errorf("Stream#%d request with bad version `%s`", syn.StreamId, proto)
+	}
+
+	header := http.Header{}
+	mergeHeader(header, syn.Header)
+	if sc.version < 3 {
+		for _, k := range []string{"Method", "Url", "Version", "Scheme"} {
+			header.Del(k)
+		}
+	}
+	header.Del("Host")
+
+	req := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     header,
+		Host:       host,
+		RequestURI: path,
+		RemoteAddr: sc.conn.RemoteAddr().String(),
+		Body:       http.NoBody,
+		Trailer:    http.Header{},
+	}
+	req.ContentLength = -1
+	if syn.Flags&FLAG_FIN != 0 {
+		req.ContentLength = 0
+	} else if cl := header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			req.ContentLength = n
+		}
+	}
+
+	if tc, ok := sc.conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		req.TLS = &state
+	}
+
+	return req, nil
+}
+
+func (sc *serverConn) runHandler(w *responseWriter, req *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			sc.logger.Error("Handler of %s panic: %v", req.URL, err)
+			if w.st != nil {
+				sc.resetStream(w.st, INTERNAL_ERROR)
+			}
+		} else {
+			w.finish()
+		}
+
+		if p := w.push; p != nil && w.st == nil {
+			// the push never started
+			p.start(errStreamClosed)
+			p.cancel()
+		}
+	}()
+
+	sc.handler.ServeHTTP(w, req)
+}
+
+func (sc *serverConn) data(dat *DataFrame) {
+	if sc.sessionFlow && !sc.recvWindow.take(int64(dat.Length), false) {
+		sc.logger.Error("Session receive window is overrun by Stream#%d", dat.StreamId)
+	}
+
+	sc.lock.Lock()
+	st, ok := sc.streams[dat.StreamId]
+	sc.lock.Unlock()
+	if !ok || st.body == nil {
+		sc.logger.Debug("Stream#%d not exist or without body, drop DataFrame", dat.StreamId)
+		sc.consumed(nil, int(dat.Length))
+		if !ok {
+			sc.output.push(NewRstStreamFrame(dat.StreamId, INVALID_STREAM))
+		}
+		return
+	}
+
+	fin := dat.Flags&FLAG_FIN != 0
+	if st.recvWindow != nil && !st.recvWindow.take(int64(dat.Length), fin) {
+		sc.logger.Error("Stream#%d receive window is overrun", dat.StreamId)
+		sc.consumed(nil, int(dat.Length))
+		sc.resetStream(st, FLOW_CONTROL_ERROR)
+		return
+	}
+
+	dat.Data.WriteTo(st.body)
+	if fin {
+		st.body.Close()
+		sc.finishRemote(st)
+	}
+}
+
+// headers takes request trailers, they are seen by the handler once it
+// reads the body to EOF.
+func (sc *serverConn) headers(hf *HeadersFrame) {
+	sc.lock.Lock()
+	st, ok := sc.streams[hf.StreamId]
+	sc.lock.Unlock()
+	if !ok {
+		sc.logger.Debug("Stream#%d not exist, ignore %v", hf.StreamId, hf)
+		return
+	}
+
+	mergeHeader(st.req.Trailer, hf.Header)
+	if hf.Flags&FLAG_FIN != 0 {
+		if st.body != nil {
+			st.body.Close()
+		}
+		sc.finishRemote(st)
+	}
+}
+
+// consumed gives bytes of the request body read by the handler back to the
+// receive windows, st is nil for DATA nobody reads.
+func (sc *serverConn) consumed(st *serverStream, n int) {
+	if sc.sessionFlow {
+		if delta := sc.recvWindow.give(int64(n)); delta > 0 {
+			sc.output.push(NewWindowUpdateFrame(0, uint32(delta)))
+		}
+	}
+	if st != nil && st.recvWindow != nil {
+		if delta := st.recvWindow.give(int64(n)); delta > 0 {
+			sc.output.push(NewWindowUpdateFrame(st.id, uint32(delta)))
+		}
+	}
+}
+
+func (sc *serverConn) windowUpdate(wu *WindowUpdateFrame) {
+	if wu.StreamId == 0 {
+		if sc.sendWindow != nil && !sc.sendWindow.add(int64(wu.DeltaWindowSize)) {
+			sc.logger.Error("Session send window overflows")
+		}
+		return
+	}
+
+	sc.lock.Lock()
+	st, ok := sc.streams[wu.StreamId]
+	sc.lock.Unlock()
+	if !ok || st.sendWindow == nil {
+		return
+	}
+	if !st.sendWindow.add(int64(wu.DeltaWindowSize)) {
+		sc.logger.Error("Stream#%d send window overflows", wu.StreamId)
+		sc.resetStream(st, FLOW_CONTROL_ERROR)
+	}
+}
+
+func (sc *serverConn) initialWindowSize(size uint32) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	delta := int64(size) - sc.initialSendWindow
+	sc.initialSendWindow = int64(size)
+	for _, st := range sc.streams {
+		if st.sendWindow != nil {
+			st.sendWindow.add(delta)
+		}
+	}
+}
+
+// finishRemote marks the request done, and forgets the stream if the
+// response is done too.
+func (sc *serverConn) finishRemote(st *serverStream) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	st.remoteFin = true
+	if st.localFin {
+		sc.forget(st)
+	}
+}
+
+// finishLocal marks the response done. The client gets CANCEL if it is
+// still sending a request body nobody will read.
+func (sc *serverConn) finishLocal(st *serverStream) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	st.localFin = true
+	if st.remoteFin {
+		sc.forget(st)
+		return
+	}
+	if _, ok := sc.streams[st.id]; ok {
+		delete(sc.streams, st.id)
+		sc.output.push(NewRstStreamFrame(st.id, CANCEL))
+		sc.closeStream(st, errStreamClosed)
+	}
+}
+
+// forget drops a finished stream, the caller holds the lock.
+func (sc *serverConn) forget(st *serverStream) {
+	delete(sc.streams, st.id)
+	st.cancel()
+}
+
+// resetStream sends RST_STREAM with status, and ends the stream.
+func (sc *serverConn) resetStream(st *serverStream, status uint32) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if _, ok := sc.streams[st.id]; !ok {
+		return
+	}
+	delete(sc.streams, st.id)
+	sc.output.push(NewRstStreamFrame(st.id, status))
+	sc.closeStream(st, &RstStreamError{StreamId: st.id, Status: status})
+}
+
+// closeStream fails the request body and the response writes of a reset
+// stream.
+func (sc *serverConn) closeStream(st *serverStream, err error) {
+	if st.body != nil {
+		st.body.CloseWithError(err)
+	}
+	if st.sendWindow != nil {
+		st.sendWindow.close()
+	}
+	st.cancel()
+}
+
+func (sc *serverConn) alive(st *serverStream) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	_, ok := sc.streams[st.id]
+	return ok
+}
+
+// requestBody is the Body of a request, the handler may close it before
+// reading it all.
+type requestBody struct {
+	body *streamBody
+}
+
+func (rb *requestBody) Read(p []byte) (int, error) {
+	return rb.body.Read(p)
+}
+
+func (rb *requestBody) Close() error {
+	rb.body.CloseWithError(errors.New("Read on closed request body"))
+	return nil
+}
+
+// responseWriter sends the response of a stream as SYN_REPLY and DATA. The
+// body is buffered up to DEFAULT_DATA_FRAME_SIZE, so a small response goes
+// out in one DataFrame, or in SYN_REPLY alone when it is empty. The response
+// of a pushed stream starts with SYN_STREAM instead.
+type responseWriter struct {
+	sc     *serverConn
+	st     *serverStream // nil until a pushed stream starts
+	push   *pushPromise
+	header http.Header
+	status int
+	buf    []byte
+
+	replied  bool
+	finished bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		w.sc.logger.Warn("Superfluous WriteHeader(%d)", status)
+		return
+	}
+	w.status = status
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.finished {
+		return 0, errors.New("Write after handler finished")
+	}
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.alive() {
+		return 0, errStreamClosed
+	}
+
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= DEFAULT_DATA_FRAME_SIZE {
+		if err := w.flush(DEFAULT_DATA_FRAME_SIZE, false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends the reply and the buffered body at once.
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.flush(len(w.buf), false)
+}
+
+// flush sends n bytes of the buffered body, and the reply before them.
+func (w *responseWriter) flush(n int, fin bool) error {
+	if !w.replied {
+		if err := w.reply(false); err != nil {
+			return err
+		}
+	}
+
+	data := w.buf[:n]
+	w.buf = w.buf[n:]
+	if len(data) == 0 && !fin {
+		return nil
+	}
+
+	return w.sendData(data, fin)
+}
+
+func (w *responseWriter) reply(fin bool) error {
+	w.replied = true
+
+	if w.header.Get("Content-Type") == "" && len(w.buf) > 0 {
+		w.header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	header := map[string]string{}
+	for k, vs := range w.header {
+		k = strings.ToLower(k)
+		if connectionHeaders[k] || strings.HasPrefix(k, strings.ToLower(http.TrailerPrefix)) {
+			continue
+		}
+		header[k] = strings.Join(vs, "\x00")
+	}
+
+	status := strconv.Itoa(w.status) + " " + http.StatusText(w.status)
+	if w.sc.version >= 3 {
+		header[":status"] = status
+		header[":version"] = "HTTP/1.1"
+	} else {
+		header["status"] = status
+		header["version"] = "HTTP/1.1"
+	}
+
+	if w.push != nil {
+		return w.sc.startPush(w, header, fin)
+	}
+
+	frame := NewSynReplyFrame(w.st.id)
+	frame.Header = header
+	if fin {
+		frame.Flags = FLAG_FIN
+	}
+
+	w.sc.output.push(frame)
+	return nil
+}
+
+// alive tells whether the response can still be written, a pushed stream
+// which has not started yet can.
+func (w *responseWriter) alive() bool {
+	if w.st == nil {
+		return w.push != nil && w.push.err == nil
+	}
+	return w.sc.alive(w.st)
+}
+
+// sendData splits data into DataFrames no larger than the send windows
+// allow, and waits for WINDOW_UPDATE when they are used up.
+func (w *responseWriter) sendData(data []byte, fin bool) error {
+	st := w.st
+	for {
+		n := int64(len(data))
+		if st.sendWindow != nil && n > 0 {
+			if n = takeWindows(st.sendWindow, w.sc.sendWindow, n); n == 0 {
+				return errStreamClosed
+			}
+		}
+
+		frame := NewDataFrame(st.id)
+		frame.Data = bytes.NewBuffer(data[:n])
+		frame.Length = uint32(n)
+		data = data[n:]
+		if fin && len(data) == 0 {
+			frame.Flags = FLAG_FIN
+		}
+		if !w.sc.output.push(frame) {
+			return errStreamClosed
+		}
+
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// trailer collects the trailers the handler declared in the Trailer header,
+// or set with http.TrailerPrefix.
+func (w *responseWriter) trailer() map[string]string {
+	trailer := map[string]string{}
+	for _, names := range w.header["Trailer"] {
+		for _, k := range strings.Split(names, ",") {
+			k = strings.TrimSpace(k)
+			if vs, ok := w.header[http.CanonicalHeaderKey(k)]; ok {
+				trailer[strings.ToLower(k)] = strings.Join(vs, "\x00")
+			}
+		}
+	}
+	for k, vs := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailer[strings.ToLower(k[len(http.TrailerPrefix):])] = strings.Join(vs, "\x00")
+		}
+	}
+	return trailer
+}
+
+// finish ends the response when the handler returns.
+func (w *responseWriter) finish() {
+	defer func() {
+		if w.st != nil {
+			w.sc.finishLocal(w.st)
+		}
+	}()
+	w.finished = true
+
+	if !w.alive() {
+		return
+	}
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	trailer := w.trailer()
+	if !w.replied {
+		if w.header.Get("Content-Length") == "" && len(trailer) == 0 {
+			w.header.Set("Content-Length", strconv.Itoa(len(w.buf)))
+		}
+		if len(w.buf) == 0 && len(trailer) == 0 {
+			w.reply(true)
+			return
+		}
+	}
+
+	if err := w.flush(len(w.buf), len(trailer) == 0); err != nil || len(trailer) == 0 {
+		return
+	}
+
+	frame := NewHeadersFrame(w.st.id)
+	frame.Header = trailer
+	frame.Flags = FLAG_FIN
+	w.sc.output.push(frame)
+}
+
+// pushPromise is a stream the server pushes. The status is in its
+// SYN_STREAM, so it starts when its handler replies.
+type pushPromise struct {
+	assoc  *serverStream
+	req    *http.Request
+	scheme string
+	cancel context.CancelFunc
+
+	once    sync.Once
+	started chan bool
+	err     error
+}
+
+// start records whether the push started, and wakes up Push.
+func (p *pushPromise) start(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.started)
+	})
+}
+
+// Push pushes target, a path or an url of the request's host, and serves it
+// with the handler as a GET request with opts.Header. It waits until the
+// handler of target replies, so the client sees the push before the end of
+// the response it is associated to.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if w.push != nil {
+		return http.ErrNotSupported
+	}
+
+	method := "GET"
+	header := http.Header{}
+	if opts != nil {
+		if opts.Method != "" {
+			method = opts.Method
+		}
+		if opts.Header != nil {
+			header = opts.Header.Clone()
+		}
+	}
+	if method != "GET" && method != "HEAD" {
+		return fmt.Errorf("Push method %s is not GET or HEAD", method)
+	}
+
+	req := w.st.req
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.IsAbs() && u.Host != req.Host {
+		return fmt.Errorf("Push target %s is not of host %s", target, req.Host)
+	} else if !u.IsAbs() && !strings.HasPrefix(target, "/") {
+		return fmt.Errorf("Push target %s is not an absolute path", target)
+	}
+
+	pushReq := &http.Request{
+		Method:     method,
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       req.Host,
+		RequestURI: u.RequestURI(),
+		RemoteAddr: req.RemoteAddr,
+		Body:       http.NoBody,
+		TLS:        req.TLS,
+	}
+	ctx, cancel := context.WithCancel(w.sc.ctx)
+
+	p := &pushPromise{
+		assoc:   w.st,
+		req:     pushReq.WithContext(ctx),
+		scheme:  "http",
+		cancel:  cancel,
+		started: make(chan bool),
+	}
+	if req.TLS != nil {
+		p.scheme = "https"
+	}
+
+	w.sc.logger.Debug("Stream#%d pushes %s", w.st.id, target)
+	go w.sc.runHandler(&responseWriter{sc: w.sc, header: http.Header{}, push: p}, p.req)
+
+	<-p.started
+	return p.err
+}
+
+// startPush sends the SYN_STREAM of a pushed stream, while the stream it is
+// associated to is open.
+func (sc *serverConn) startPush(w *responseWriter, header map[string]string, fin bool) error {
+	p := w.push
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if _, ok := sc.streams[p.assoc.id]; !ok || p.assoc.localFin {
+		sc.logger.Debug("Stream#%d is closed, drop push of %s", p.assoc.id, p.req.URL)
+		p.start(errStreamClosed)
+		return errStreamClosed
+	}
+
+	if sc.lastOutId == 0 {
+		sc.lastOutId = 2
+	} else {
+		sc.lastOutId += 2
+	}
+	st := &serverStream{
+		id:        sc.lastOutId,
+		priority:  p.assoc.priority,
+		req:       p.req,
+		cancel:    p.cancel,
+		remoteFin: true,
+	}
+	if sc.version >= 3 {
+		st.sendWindow = newWindow(sc.initialSendWindow)
+	}
+	sc.streams[st.id] = st
+	w.st = st
+
+	syn := NewSynStreamFrame(st.id)
+	syn.AssociatedId = p.assoc.id
+	syn.Priority = st.priority
+	syn.Header = header
+	syn.Flags = FLAG_UNIDIRECTIONAL
+	if fin {
+		syn.Flags |= FLAG_FIN
+	}
+	if sc.version >= 3 {
+		header[":scheme"] = p.scheme
+		header[":host"] = p.req.Host
+		header[":path"] = p.req.URL.RequestURI()
+	} else {
+		header["url"] = p.scheme + "://" + p.req.Host + p.req.URL.RequestURI()
+	}
+
+	sc.output.push(syn)
+	p.start(nil)
+	return nil
+}
@@ -0,0 +1,268 @@
+package spdy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTest serves handler with srv on a net.Pipe speaking proto, and returns
+// a Framer of the client end, which fails after 5 seconds.
+func serveTest(t *testing.T, srv *Server, proto string, handler http.HandlerFunc) *Framer {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	srv.Handler = handler
+	go srv.ServeConn(server, proto)
+
+	version, _ := protoVersion(proto)
+	framer, err := NewFramer(client, client, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return framer
+}
+
+// newTestSyn is the SYN_STREAM of a request with the headers of version.
+func newTestSyn(version uint16, streamId uint32, method, path string, fin bool) *SynStreamFrame {
+	syn := NewSynStreamFrame(streamId)
+	prefix, pathKey := "", "url"
+	if version >= 3 {
+		prefix, pathKey = ":", ":path"
+	}
+	syn.Header = map[string]string{
+		prefix + "method":  method,
+		prefix + "version": "HTTP/1.1",
+		prefix + "scheme":  "http",
+		prefix + "host":    "origin.test",
+		pathKey:            path,
+	}
+	if fin {
+		syn.Flags = FLAG_FIN
+	}
+	return syn
+}
+
+// testResponse is what the server sent on a stream.
+type testResponse struct {
+	header  map[string]string
+	assoc   uint32
+	body    string
+	trailer map[string]string
+	status  uint32 // of RST_STREAM
+	fin     bool
+}
+
+// readResponses reads the streams the server sends until n of them are
+// finished, other frames are dropped.
+func readResponses(t *testing.T, framer *Framer, n int) map[uint32]*testResponse {
+	responses := map[uint32]*testResponse{}
+	get := func(streamId uint32) *testResponse {
+		if responses[streamId] == nil {
+			responses[streamId] = &testResponse{}
+		}
+		return responses[streamId]
+	}
+	finish := func(res *testResponse, flags uint8) {
+		if flags&FLAG_FIN != 0 {
+			res.fin = true
+			n--
+		}
+	}
+
+	for n > 0 {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("%v with %d streams left", err, n)
+		}
+		switch f := f.(type) {
+		case *SynReplyFrame:
+			res := get(f.StreamId)
+			res.header = f.Header
+			finish(res, f.Flags)
+		case *SynStreamFrame:
+			res := get(f.StreamId)
+			res.header, res.assoc = f.Header, f.AssociatedId
+			finish(res, f.Flags)
+		case *DataFrame:
+			res := get(f.StreamId)
+			res.body += f.Data.String()
+			finish(res, f.Flags)
+		case *HeadersFrame:
+			res := get(f.StreamId)
+			res.trailer = f.Header
+			finish(res, f.Flags)
+		case *RstStreamFrame:
+			get(f.StreamId).status = f.Status
+			n--
+		}
+	}
+	return responses
+}
+
+// statusKey is the header of the response status in version.
+func statusKey(version uint16) string {
+	if version >= 3 {
+		return ":status"
+	}
+	return "status"
+}
+
+func TestServerRequest(t *testing.T) {
+	for _, proto := range []string{"spdy/2", "spdy/3"} {
+		got := make(chan string, 1)
+		framer := serveTest(t, &Server{}, proto, func(w http.ResponseWriter, r *http.Request) {
+			got <- fmt.Sprintf("%s %s %s %s %v %d", r.Method, r.RequestURI, r.Host, r.Proto, r.Header, r.ContentLength)
+			w.Header().Set("X-Answer", "42")
+			io.WriteString(w, "hello")
+		})
+		version := framer.Version
+
+		syn := newTestSyn(version, 1, "GET", "/path?q=1", true)
+		syn.Header["accept"] = "text/plain\x00text/html"
+		if err := framer.WriteFrame(syn); err != nil {
+			t.Fatal(err)
+		}
+
+		res := readResponses(t, framer, 1)[1]
+		want := "GET /path?q=1 origin.test HTTP/1.1 map[Accept:[text/plain text/html]] 0"
+		if r := <-got; r != want {
+			t.Errorf("%s: handler got %s, want %s", proto, r, want)
+		}
+		if res.header[statusKey(version)] != "200 OK" || res.header["x-answer"] != "42" || res.header["content-length"] != "5" {
+			t.Errorf("%s: reply %v", proto, res.header)
+		}
+		if res.body != "hello" || !res.fin {
+			t.Errorf("%s: body %q, fin %v", proto, res.body, res.fin)
+		}
+	}
+}
+
+func TestServerRequestBodyAndTrailer(t *testing.T) {
+	for _, proto := range []string{"spdy/2", "spdy/3"} {
+		framer := serveTest(t, &Server{}, proto, func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Trailer", "X-Sum")
+			w.Write(b)
+			w.Header().Set("X-Sum", r.Trailer.Get("X-Sum"))
+		})
+		version := framer.Version
+
+		framer.WriteFrame(newTestSyn(version, 1, "POST", "/", false))
+		framer.WriteFrame(newTestData(1, "part1 ", 0))
+		framer.WriteFrame(newTestData(1, "part2", 0))
+		trailer := NewHeadersFrame(1)
+		trailer.Flags = FLAG_FIN
+		trailer.Header = map[string]string{"x-sum": "abc"}
+		framer.WriteFrame(trailer)
+
+		res := readResponses(t, framer, 1)[1]
+		if res.body != "part1 part2" {
+			t.Errorf("%s: body %q", proto, res.body)
+		}
+		if want := map[string]string{"x-sum": "abc"}; !reflect.DeepEqual(res.trailer, want) || !res.fin {
+			t.Errorf("%s: trailer %v, fin %v, want %v", proto, res.trailer, res.fin, want)
+		}
+	}
+}
+
+// A response is sent as the client opens the spdy/3.1 session window, a
+// little at a time, the stream window being larger.
+func TestServerResponseFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 4*DEFAULT_WINDOW_SIZE)
+	framer := serveTest(t, &Server{}, "spdy/3.1", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})
+	framer.WriteFrame(NewSettingsFrame([]Setting{{SETTINGS_INITIAL_WINDOW_SIZE, 0, 1 << 20}}))
+	framer.WriteFrame(newTestSyn(3, 1, "GET", "/", true))
+
+	var got strings.Builder
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dat, ok := f.(*DataFrame)
+		if !ok {
+			continue
+		}
+		got.Write(dat.Data.Bytes())
+		if dat.Flags&FLAG_FIN != 0 {
+			break
+		}
+		framer.WriteFrame(NewWindowUpdateFrame(0, 1000))
+	}
+	if got.Len() != len(body) {
+		t.Errorf("body of %d bytes, want %d", got.Len(), len(body))
+	}
+}
+
+func TestServerMaxConcurrentStreams(t *testing.T) {
+	release := make(chan bool)
+	framer := serveTest(t, &Server{MaxConcurrentStreams: 1}, "spdy/3", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	f, err := framer.ReadFrame()
+	set, ok := f.(*SettingsFrame)
+	if want := []Setting{{SETTINGS_MAX_CONCURRENT_STREAMS, 0, 1}}; err != nil || !ok || !reflect.DeepEqual(set.Settings, want) {
+		t.Fatalf("read %v, %v first, want SETTINGS %v", f, err, want)
+	}
+
+	framer.WriteFrame(newTestSyn(3, 1, "GET", "/", true))
+	framer.WriteFrame(newTestSyn(3, 3, "GET", "/", true))
+	if res := readResponses(t, framer, 1)[3]; res == nil || res.status != REFUSED_STREAM {
+		t.Fatalf("Stream#3 %+v, want REFUSED_STREAM", res)
+	}
+
+	close(release)
+	if res := readResponses(t, framer, 1)[1]; res == nil || res.header[":status"] != "200 OK" {
+		t.Errorf("Stream#1 %+v, want 200 OK", res)
+	}
+}
+
+func TestServerPush(t *testing.T) {
+	for _, proto := range []string{"spdy/2", "spdy/3"} {
+		framer := serveTest(t, &Server{}, proto, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/style.css" {
+				if r.Header.Get("X-Pushed") != "1" {
+					t.Errorf("%s: pushed request of header %v", proto, r.Header)
+				}
+				io.WriteString(w, "css")
+				return
+			}
+			opts := &http.PushOptions{Header: http.Header{"X-Pushed": {"1"}}}
+			if err := w.(http.Pusher).Push("/style.css", opts); err != nil {
+				t.Errorf("%s: %v", proto, err)
+			}
+			io.WriteString(w, "page")
+		})
+		version := framer.Version
+
+		framer.WriteFrame(newTestSyn(version, 1, "GET", "/", true))
+		responses := readResponses(t, framer, 2)
+
+		page, css := responses[1], responses[2]
+		if page == nil || page.body != "page" {
+			t.Fatalf("%s: Stream#1 %+v", proto, page)
+		}
+		if css == nil || css.assoc != 1 || css.body != "css" || css.header[statusKey(version)] != "200 OK" {
+			t.Fatalf("%s: pushed Stream#2 %+v", proto, css)
+		}
+		url := css.header["url"]
+		if version >= 3 {
+			url = css.header[":scheme"] + "://" + css.header[":host"] + css.header[":path"]
+		}
+		if url != "http://origin.test/style.css" {
+			t.Errorf("%s: pushed %s", proto, url)
+		}
+	}
+}
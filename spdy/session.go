@@ -1,331 +1,752 @@
 package spdy
 
 import (
-	"bytes"
-	"compress/zlib"
-	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const FRAME_BUFFER_SIZE = 100
 
+const PING_TIMEOUT = 30 * time.Second
+
+var ErrSessionGoingAway = errors.New("Session is going away")
+
+// ErrSessionClosed is delivered to the streams of a session which is closed,
+// wrapping the I/O error when the connection failed.
+var ErrSessionClosed = errors.New("Session is closed")
+
+// ErrResponseHeaderTimeout and ErrBodyIdleTimeout are delivered to streams
+// reset by the timeouts of their session.
+var (
+	ErrResponseHeaderTimeout = errors.New("Timeout awaiting response headers")
+	ErrBodyIdleTimeout       = errors.New("Timeout awaiting response body")
+)
+
 type Session interface {
 	Serve()
 	Close()
-	Request(*http.Request, Handle) uint32
+	Request(*http.Request, Handle) (uint32, error)
+	CancelStream(uint32) error
 }
 
-type HttpSession struct {
-	conn   net.Conn
-	client *httputil.ClientConn
+type SpdySession struct {
+	conn     net.Conn
+	Version  uint16
+	output   *scheduler
+	input    chan Frame
+	lastInId uint32
+	closed   atomic.Bool
+	failOnce sync.Once
+	failure  error // the first error of the connection
+	framer   *Framer
+
+	// pingLock guards the pings waiting for their echo
+	pingLock sync.Mutex
+	pings    map[uint32]chan bool
+	lastPing uint32
+
+	// streamLock guards the stream table, the settings of the server, the
+	// last stream id and GOAWAY, as requests are made from any goroutine
+	// while proc serves the streams. Streams beyond
+	// SETTINGS_MAX_CONCURRENT_STREAMS wait in pending. Setting reads the
+	// settings.
+	streamLock     sync.Mutex
+	streams        map[uint32]*Stream
+	serverSettings map[uint32]Setting
+	lastOutId      uint32
+	goingAway      bool
+	maxStreams     uint32
+	active         uint32
+	pending        []*Stream
+
+	// SessionFlowControl adds the session wide flow control window of
+	// spdy/3.1 to the per stream windows of spdy/3.
+	SessionFlowControl bool
+
+	initialSendWindow int64
+	initialRecvWindow int64
+	sendWindow        *window
+	recvWindow        *recvWindow
+
+	// MaxDataFrameSize bounds the DataFrames of request bodies, it is
+	// DEFAULT_DATA_FRAME_SIZE when 0.
+	MaxDataFrameSize int
+
+	// PushHandle receives the streams the server pushes for the origin of
+	// their associated stream, other pushes are refused with
+	// REFUSED_STREAM, and all of them when it is nil.
+	PushHandle PushHandle
+
+	// SettingsStore keeps the settings the server asks to persist for
+	// Origin, they are sent back when a new session starts serving.
+	SettingsStore *SettingsStore
+	Origin        string
+
+	// Logger of the session, the package logger by default.
+	Logger *Logger
+
+	// ResponseHeaderTimeout limits the wait for SYN_REPLY once SYN_STREAM
+	// is sent, and BodyIdleTimeout the wait for each DataFrame of the
+	// response. Streams are reset with CANCEL when they expire, 0 waits
+	// forever.
+	ResponseHeaderTimeout time.Duration
+	BodyIdleTimeout       time.Duration
+
+	// client replays the requests of the session after GOAWAY
+	client *Client
 }
 
-func NewHttpSession(conn net.Conn) *HttpSession {
-	hs := &HttpSession{
-		conn:   conn,
-		client: httputil.NewClientConn(conn, nil),
+func NewSpdySession(conn net.Conn, writer io.Writer, reader io.Reader, version uint16) *SpdySession {
+	se := &SpdySession{
+		conn:           conn,
+		Version:        version,
+		output:         newScheduler(),
+		input:          make(chan Frame, FRAME_BUFFER_SIZE),
+		streams:        map[uint32]*Stream{},
+		serverSettings: map[uint32]Setting{},
+		pings:          map[uint32]chan bool{},
+		Logger:         log,
+
+		// unlimited until the server sends SETTINGS_MAX_CONCURRENT_STREAMS
+		maxStreams: math.MaxUint32,
+
+		initialSendWindow: DEFAULT_WINDOW_SIZE,
+		initialRecvWindow: DEFAULT_WINDOW_SIZE,
+		recvWindow:        newRecvWindow(DEFAULT_WINDOW_SIZE),
+	}
+
+	var err error
+	se.framer, err = NewFramer(writer, reader, version)
+	if err != nil {
+		se.Logger.Error("%v", err)
+		return nil
 	}
-	return hs
-}
 
-func (hs *HttpSession) Serve() {
-	// do nothing
+	return se
 }
 
-func (hs *HttpSession) Close() {
-	log.Debug("Close http session %s => %s", hs.conn.LocalAddr(), hs.conn.RemoteAddr())
-	hs.conn.Close()
+func (se *SpdySession) Request(req *http.Request, handle Handle) (uint32, error) {
+	return se.RequestWithPriority(req, 0, handle)
 }
 
-func (hs *HttpSession) Request(req *http.Request, handle Handle) uint32 {
-	res, err := hs.client.Do(req)
-	if err != nil {
-		log.Error("%v", err)
-		return 0
+// RequestWithPriority sends req with priority, 0 is the highest. spdy/2 has
+// priorities 0 to 3 and spdy/3 0 to 7, a lower one is used as the lowest.
+// The server answers streams of higher priority first, and their request
+// bodies are sent first. When req's context is done the stream is reset with
+// CANCEL, and the context's error is delivered to it.
+func (se *SpdySession) RequestWithPriority(req *http.Request, priority uint8, handle Handle) (uint32, error) {
+	se.streamLock.Lock()
+	defer se.streamLock.Unlock()
+
+	if se.closed.Load() {
+		return 0, ErrSessionClosed
 	}
+	if se.goingAway {
+		return 0, ErrSessionGoingAway
+	}
+
+	se.Logger.Debug("Request %s", req.URL.String())
+
+	streamId := se.nextOutId()
+
+	stream := se.newStream(streamId)
+	stream.handle = handle
+	stream.Request = req
+	stream.priority = se.lowestPriority(priority)
+	se.streams[streamId] = stream
+	stream.watchContext(req.Context())
 
-	// callback
-	handle(0, res, nil)
+	if se.active >= se.maxStreams || len(se.pending) > 0 {
+		se.Logger.Debug("Stream#%d waits in queue, %d streams are active", streamId, se.active)
+		se.pending = append(se.pending, stream)
+	} else {
+		se.start(stream)
+	}
 
-	return 0
+	return streamId, nil
 }
 
-type SpdySession struct {
-	conn      net.Conn
-	Version   uint16
-	output    chan Frame
-	input     chan Frame
-	LastInId  uint32
-	LastOutId uint32
-	r         io.Reader
-	lr        *io.LimitedReader
-	zr        io.ReadCloser
-	w         io.Writer
-	buf       *bytes.Buffer
-	zw        *zlib.Writer
-	Streams   map[uint32]*Stream
-	Settings  []Setting
+// lowestPriority limits priority to the lowest the version allows.
+func (se *SpdySession) lowestPriority(priority uint8) uint8 {
+	lowest := uint8(3)
+	if se.Version >= 3 {
+		lowest = 7
+	}
+	if priority > lowest {
+		return lowest
+	}
+	return priority
 }
 
-func NewSpdySession(conn net.Conn, writer io.Writer, reader io.Reader, version uint16) Session {
-	se := &SpdySession{
-		conn:      conn,
-		Version:   version,
-		output:    make(chan Frame, FRAME_BUFFER_SIZE),
-		input:     make(chan Frame, FRAME_BUFFER_SIZE),
-		LastOutId: 0,
-		r:         reader,
-		w:         writer,
-		Streams:   map[uint32]*Stream{},
+// start sends SYN_STREAM of st, the caller holds streamLock.
+func (se *SpdySession) start(st *Stream) {
+	se.active++
+	st.started = true
+	st.watch(se.ResponseHeaderTimeout, ErrResponseHeaderTimeout)
+	st.Syn(se.output, st.Request)
+}
+
+// release starts the queued streams that SETTINGS_MAX_CONCURRENT_STREAMS
+// allows now, the caller holds streamLock.
+func (se *SpdySession) release() {
+	for len(se.pending) > 0 && !se.goingAway && se.active < se.maxStreams {
+		st := se.pending[0]
+		se.pending = se.pending[1:]
+		se.Logger.Debug("Stream#%d leaves queue", st.StreamId)
+		se.start(st)
 	}
+}
 
-	se.buf = new(bytes.Buffer)
-	var err error
-	se.zw, err = zlib.NewWriterLevelDict(se.buf, zlib.BestCompression, []byte(HeaderDict))
-	if err != nil {
-		log.Error("%v", err)
-		return nil
+func (se *SpdySession) newStream(streamId uint32) *Stream {
+	st := NewStream(streamId)
+	st.version = se.Version
+	st.session = se
+	st.logger = se.Logger
+
+	if se.Version >= 3 {
+		st.sendWindow = newWindow(se.initialSendWindow)
+		st.recvWindow = newRecvWindow(se.initialRecvWindow)
 	}
 
-	return se
+	return st
 }
 
-func (se *SpdySession) Request(req *http.Request, handle Handle) uint32 {
-	log.Debug("Request %s", req.URL.String())
+// resetStream sends RST_STREAM with status, and delivers the error to the
+// stream.
+func (se *SpdySession) resetStream(st *Stream, status uint32) {
+	if _, ok := se.removeStream(st.StreamId); !ok {
+		return
+	}
+	se.output.push(NewRstStreamFrame(st.StreamId, status))
+	st.Reset(&RstStreamError{StreamId: st.StreamId, Status: status})
+}
 
-	streamId := se.nextOutId()
+// CancelStream resets the stream with CANCEL, so the server stops sending,
+// and delivers a *RstStreamError to the stream's Handle.
+func (se *SpdySession) CancelStream(streamId uint32) error {
+	st, ok := se.stream(streamId)
+	if !ok || !se.cancel(st, &RstStreamError{StreamId: streamId, Status: CANCEL}) {
+		return errors.New("Stream not exist in session")
+	}
+	return nil
+}
 
-	go func() {
-		stream := NewStream(streamId)
-		stream.handle = handle
-		se.Streams[streamId] = stream
+// cancel resets st with CANCEL if it is still in the session, and delivers
+// err to it.
+func (se *SpdySession) cancel(st *Stream, err error) bool {
+	if _, ok := se.removeStream(st.StreamId); !ok {
+		return false
+	}
+	se.Logger.Debug("Stream#%d canceled: %v", st.StreamId, err)
 
-		stream.Syn(se.output, req, se.w, se.buf, se.zw)
-	}()
-	return streamId
+	if st.started {
+		se.output.push(NewRstStreamFrame(st.StreamId, CANCEL))
+	}
+	st.Reset(err)
+	return true
 }
 
-func (se *SpdySession) nextOutId() uint32 {
-	if se.LastOutId == 0 {
-		se.LastOutId = 1
+// stream returns the stream of streamId while it is in the session.
+func (se *SpdySession) stream(streamId uint32) (*Stream, bool) {
+	se.streamLock.Lock()
+	defer se.streamLock.Unlock()
+
+	st, ok := se.streams[streamId]
+	return st, ok
+}
+
+// removeStream forgets a finished stream, and closes the session once the
+// last stream allowed by a GOAWAY is done. Only the caller which removes the
+// stream gets ok, so a stream reset from several goroutines at once is reset
+// once.
+func (se *SpdySession) removeStream(streamId uint32) (*Stream, bool) {
+	se.streamLock.Lock()
+	defer se.streamLock.Unlock()
+
+	st, ok := se.streams[streamId]
+	if !ok {
+		return nil, false
+	}
+	if st.sendWindow != nil {
+		st.sendWindow.close()
+	}
+	st.unwatch()
+	delete(se.streams, streamId)
+
+	if st.started && streamId%2 == 1 {
+		se.active--
+		se.release()
 	} else {
-		se.LastOutId += 2
+		se.dequeue(st)
 	}
 
-	return se.LastOutId
+	if se.goingAway && len(se.streams) == 0 {
+		se.Logger.Debug("All streams are done after GOAWAY")
+		se.Close()
+	}
+	return st, true
 }
 
-func (ss *SpdySession) Serve() {
-	go ss.recv()
-	go ss.send()
-	go ss.proc()
+// goaway stops the session from accepting requests, and replays streams the
+// server has not processed on a new session of its client.
+func (se *SpdySession) goaway(ga *GoawayFrame) {
+	if se.client != nil {
+		se.client.removeSession(se)
+	}
 
-	log.Debug("Session is serving")
-}
+	se.streamLock.Lock()
+	defer se.streamLock.Unlock()
 
-func (ss *SpdySession) Close() {
-	log.Debug("Close spdy session %s => %s", ss.conn.LocalAddr(), ss.conn.RemoteAddr())
-	ss.conn.Close()
+	se.goingAway = true
+	se.pending = nil
+
+	for streamId, st := range se.streams {
+		if streamId <= ga.LastGoodId || streamId%2 == 0 {
+			continue
+		}
+		se.Logger.Debug("Stream#%d is beyond last good Stream#%d, replay it", streamId, ga.LastGoodId)
+		if st.sendWindow != nil {
+			st.sendWindow.close()
+		}
+		st.unwatch()
+		delete(se.streams, streamId)
+		if se.client != nil {
+			go se.client.replay(st.Request, st.priority, st.handle)
+		} else {
+			go st.Reset(ErrSessionGoingAway)
+		}
+	}
+
+	if len(se.streams) == 0 {
+		se.Close()
+	}
 }
 
-func (se *SpdySession) send() {
-	for frame := range se.output {
-		switch frame.(type) {
-		case *SynStreamFrame:
-			syn, _ := frame.(*SynStreamFrame)
-			syn.write(se.w, se.buf, se.zw)
-		case *DataFrame:
-			dat, _ := frame.(*DataFrame)
-			dat.write(se.w)
-		case *SynReplyFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame SynStreamFrame")
-		case *RstStreamFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame RstStreamFrame")
-		case *SettingsFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame SettingsFrame")
-		case *NoopFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame NoopFrame")
-		case *PingFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame PingFrame")
-		case *GoawayFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame GoawayFrame")
-		case *HeadersFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame HeadersFrame")
-		default:
-			log.Error("%v", "unreachable code")
+// dequeue drops st from the queue, the caller holds streamLock.
+func (se *SpdySession) dequeue(st *Stream) {
+	for i, p := range se.pending {
+		if p == st {
+			se.pending = append(se.pending[:i], se.pending[i+1:]...)
+			return
 		}
 	}
-	log.Debug("Session output frame Closed")
 }
 
-func (se *SpdySession) recv() {
-	for {
-		var headFirst uint32
-		binary.Read(se.r, binary.BigEndian, &headFirst)
+// push accepts a server initiated stream, and passes its response to the
+// PushHandle once the SYN_STREAM is parsed.
+func (se *SpdySession) push(syn *SynStreamFrame) {
+	se.lastInId = syn.StreamId
 
-		log.Debug("Receive head from Session: %08x", headFirst)
+	if syn.StreamId%2 != 0 || syn.AssociatedId == 0 {
+		se.Logger.Error("Pushed Stream#%d must be even and associated", syn.StreamId)
+		se.output.push(NewRstStreamFrame(syn.StreamId, PROTOCOL_ERROR))
+		return
+	}
+	assoc, ok := se.stream(syn.AssociatedId)
+	if !ok {
+		se.Logger.Error("Pushed Stream#%d associated to not exist Stream#%d", syn.StreamId, syn.AssociatedId)
+		se.output.push(NewRstStreamFrame(syn.StreamId, INVALID_STREAM))
+		return
+	}
+	if se.PushHandle == nil {
+		se.Logger.Debug("Refuse pushed Stream#%d", syn.StreamId)
+		se.output.push(NewRstStreamFrame(syn.StreamId, REFUSED_STREAM))
+		return
+	}
 
-		var frame Frame
-		var err error
-		if headFirst&0x80000000 != 0 {
-			frame, err = se.readCtrlFrame(headFirst)
-		} else {
-			frame, err = se.readDataFrame(headFirst)
-		}
-		if err != nil {
-			log.Error("%v", err)
-			break
+	url := syn.Header["url"]
+	if se.Version >= 3 {
+		url = syn.Header[":scheme"] + "://" + syn.Header[":host"] + syn.Header[":path"]
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		se.Logger.Error("Pushed Stream#%d with bad url `%s`: %v", syn.StreamId, url, err)
+		se.output.push(NewRstStreamFrame(syn.StreamId, PROTOCOL_ERROR))
+		return
+	}
+	if !sameOrigin(req, assoc.Request) {
+		se.Logger.Error("Pushed Stream#%d of `%s` is cross-origin to Stream#%d", syn.StreamId, url, syn.AssociatedId)
+		se.output.push(NewRstStreamFrame(syn.StreamId, REFUSED_STREAM))
+		return
+	}
+
+	st := se.newStream(syn.StreamId)
+	st.Request = req
+	st.handle = func(streamId uint32, res *http.Response, err error) {
+		se.Logger.Debug("Pushed Stream#%d: %v", streamId, err)
+	}
+	if err := st.SynToResponse(syn); err != nil {
+		se.Logger.Error("%v", err)
+		se.output.push(NewRstStreamFrame(syn.StreamId, PROTOCOL_ERROR))
+		return
+	}
+	if syn.Flags&FLAG_FIN == 0 {
+		se.streamLock.Lock()
+		se.streams[syn.StreamId] = st
+		se.streamLock.Unlock()
+	}
+
+	se.PushHandle(url, syn.AssociatedId, st.Response)
+}
+
+// sameOrigin tells whether the pushed request has the scheme, host and port
+// of the request it is associated to, a server may only push those.
+func sameOrigin(pushed, assoc *http.Request) bool {
+	scheme := assoc.URL.Scheme
+	host := assoc.Host
+	if host == "" {
+		host = assoc.URL.Host
+	}
+	return strings.EqualFold(pushed.URL.Scheme, scheme) &&
+		strings.EqualFold(addPort(pushed.URL.Scheme, pushed.URL.Host), addPort(scheme, host))
+}
+
+// nextOutId allocates the id of a new stream, the caller holds streamLock so
+// SYN_STREAMs are queued in the order of their ids.
+func (se *SpdySession) nextOutId() uint32 {
+	if se.lastOutId == 0 {
+		se.lastOutId = 1
+	} else {
+		se.lastOutId += 2
+	}
+
+	return se.lastOutId
+}
+
+// Ping sends a PING with the next odd id and waits for the server to echo
+// it, returning the measured round-trip time.
+func (se *SpdySession) Ping() (time.Duration, error) {
+	if se.closed.Load() {
+		return 0, ErrSessionClosed
+	}
+	pong := make(chan bool, 1)
+
+	se.pingLock.Lock()
+	if se.lastPing == 0 {
+		se.lastPing = 1
+	} else {
+		se.lastPing += 2
+	}
+	pingId := se.lastPing
+	se.pings[pingId] = pong
+	se.pingLock.Unlock()
+
+	start := time.Now()
+	se.output.push(NewPingFrame(pingId))
+
+	select {
+	case ok := <-pong:
+		if !ok {
+			return 0, ErrSessionClosed
 		}
+		rtt := time.Since(start)
+		se.Logger.Debug("Ping#%d round-trip time %v", pingId, rtt)
+		return rtt, nil
+	case <-time.After(PING_TIMEOUT):
+		se.pingLock.Lock()
+		delete(se.pings, pingId)
+		se.pingLock.Unlock()
+		return 0, errors.New("Ping timeout")
+	}
+}
 
-		log.Debug("Frame to input queue")
-		se.input <- frame
+func (se *SpdySession) pong(ping *PingFrame) {
+	if ping.PingId%2 == 0 {
+		se.Logger.Debug("Echo server Ping#%d", ping.PingId)
+		se.output.push(ping)
+		return
+	}
+
+	se.pingLock.Lock()
+	pong, ok := se.pings[ping.PingId]
+	delete(se.pings, ping.PingId)
+	se.pingLock.Unlock()
 
-		log.Trace("Session input frames length=%d", len(se.input))
+	if !ok {
+		se.Logger.Warn("Unexpected Ping#%d, ignore it", ping.PingId)
+		return
 	}
+	pong <- true
 }
 
-func (se *SpdySession) readDataFrame(headFirst uint32) (Frame, error) {
-	log.Debug("Read DataFrame with headFirst %08x", headFirst)
+func (ss *SpdySession) Serve() {
+	ss.framer.Logger = ss.Logger
+	ss.output.logger = ss.Logger
 
-	streamId := headFirst & 0x7fffffff
+	if ss.SessionFlowControl {
+		ss.sendWindow = newWindow(DEFAULT_WINDOW_SIZE)
+	}
 
-	if _, ok := se.Streams[streamId]; !ok {
-		return nil, errors.New("DataFrame streamId not exist in session")
+	if ss.SettingsStore != nil {
+		if persisted := ss.SettingsStore.Get(ss.Origin); len(persisted) > 0 {
+			ss.Logger.Debug("Send persisted settings of %s: %v", ss.Origin, persisted)
+			ss.output.push(NewSettingsFrame(persisted))
+		}
 	}
 
-	var flagsLength uint32
-	binary.Read(se.r, binary.BigEndian, &flagsLength)
+	go ss.recv()
+	go ss.send()
+	go ss.proc()
+
+	ss.Logger.Debug("Session is serving")
+}
 
-	f := &DataFrame{
-		StreamId: streamId,
-		Flags:    uint8(flagsLength >> 24),
-		Length:   flagsLength & 0x00ffffff,
+// Close closes the connection, the streams left fail with ErrSessionClosed
+// and later requests are refused with it.
+func (ss *SpdySession) Close() {
+	ss.Logger.Debug("Close spdy session %s => %s", ss.conn.LocalAddr(), ss.conn.RemoteAddr())
+	ss.closed.Store(true)
+	ss.conn.Close()
+	ss.output.close()
+}
+
+// fail records the first error of the connection, the streams left get it
+// when the session shuts down.
+func (se *SpdySession) fail(err error) {
+	se.failOnce.Do(func() {
+		se.failure = err
+	})
+}
+
+// shutdown closes the session once proc has handled the frames read before
+// the connection failed or was closed, and fails every stream and ping left.
+func (se *SpdySession) shutdown() {
+	se.fail(ErrSessionClosed)
+	err := se.failure
+
+	se.Close()
+	if se.client != nil {
+		se.client.removeSession(se)
 	}
 
-	if f.StreamId == 0 {
-		return nil, errors.New("DataFrame StreamId must not 0")
+	se.streamLock.Lock()
+	streams := se.streams
+	se.streams = map[uint32]*Stream{}
+	se.pending = nil
+	se.streamLock.Unlock()
+
+	for _, st := range streams {
+		st.unwatch()
+		st.Reset(err)
 	}
 
-	return f.ReadBody(se.r)
+	se.pingLock.Lock()
+	for pingId, pong := range se.pings {
+		delete(se.pings, pingId)
+		close(pong)
+	}
+	se.pingLock.Unlock()
 }
 
-func (se *SpdySession) readCtrlFrame(headFirst uint32) (Frame, error) {
-	log.Debug("Read CtrlFrame with headFirst %08x", headFirst)
-	var flagsLength uint32
-	binary.Read(se.r, binary.BigEndian, &flagsLength)
-
-	head := CtrlFrameHead{
-		Version: uint16(headFirst & 0x7fff0000 >> 16),
-		Type:    uint16(headFirst & 0xffff),
-		Flags:   uint8(flagsLength >> 24),
-		Length:  flagsLength & 0xffffff,
-	}
-
-	if head.Version == 0 {
-		return nil, errors.New("CtrlFrame Version must not 0")
-	} else if head.Length == 0 {
-		return nil, errors.New("CtrlFrame Length must not 0")
-	} else if head.Type == 0 {
-		return nil, errors.New("CtrlFrame Type must not 0")
-	}
-
-	switch head.Type {
-	case SYN_REPLY:
-		log.Debug("read SYN_REPLY")
-		reply := &SynReplyFrame{CtrlFrameHead: head}
-
-		reply.Read(se.r)
-		// read header
-		se.wrapReader(reply.Length - 6)
-		reply.ReadHeader(se.zr)
-
-		return reply, nil
-	case SETTINGS:
-		set := &SettingsFrame{CtrlFrameHead: head}
-		set.Read(se.r)
-
-		return set, nil
-	case SYN_STREAM:
-		return nil, errors.New("unimplemented SYN_STREAM")
-	case GOAWAY:
-		ga := &GoawayFrame{CtrlFrameHead: head}
-		ga.Read(se.r)
-
-		return ga, nil
-	case RST_STREAM:
-		return nil, errors.New("unimplemented NewCtrlFrame RST_STREAM")
-	case NOOP:
-		return nil, errors.New("unimplemented NewCtrlFrame NOOP")
-	case PING:
-		return nil, errors.New("unimplemented NewCtrlFrame PING")
-	case HEADERS:
-		return nil, errors.New("unimplemented NewCtrlFrame HEADERS")
-	default:
-		return nil, errors.New("unknown CtrlFrame Type")
-
-	}
-	return nil, errors.New("unreadable code")
+// closeError is the error the streams of a session get when its connection
+// fails with err.
+func closeError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return ErrSessionClosed
+	}
+	return fmt.Errorf("%w: %w", ErrSessionClosed, err)
 }
 
-func (se *SpdySession) wrapReader(length uint32) {
-	if se.lr == nil {
-		log.Debug("init BufferWrapper length=%d", length)
-		se.lr = &io.LimitedReader{R: se.r, N: int64(length)}
+func (se *SpdySession) send() {
+	for {
+		frame, ok := se.output.pop()
+		if !ok {
+			break
+		}
+
+		if err := se.framer.WriteFrame(frame); err != nil {
+			se.Logger.Error("%v", err)
+			se.fail(closeError(err))
+			se.Close()
+			break
+		}
+	}
+	se.Logger.Debug("Session output frame Closed")
+}
 
-		var err error
-		se.zr, err = zlib.NewReaderDict(se.lr, []byte(HeaderDict))
+// recv reads frames for proc until the connection fails.
+func (se *SpdySession) recv() {
+	defer close(se.input)
+
+	for {
+		frame, err := se.framer.ReadFrame()
+		if err == ErrUnknownFrame {
+			continue
+		}
 		if err != nil {
-			log.Error("%v", err)
+			if se.closed.Load() {
+				se.Logger.Debug("%v", err)
+			} else {
+				se.Logger.Error("%v", err)
+			}
+			se.fail(closeError(err))
+			return
 		}
-	} else {
-		log.Debug("Chang LimitedReader length to %d", length)
-		se.lr.N = int64(length)
+
+		se.Logger.Debug("Frame to input queue")
+		se.input <- frame
+
+		se.Logger.Trace("Session input frames length=%d", len(se.input))
 	}
 }
 
+// proc handles the frames recv reads, and shuts the session down once recv
+// stops.
 func (se *SpdySession) proc() {
 	for frame := range se.input {
 		switch frame.(type) {
 		case *SynReplyFrame:
-			log.Debug("SynReplyFrame from input queue")
+			se.Logger.Debug("SynReplyFrame from input queue")
 			reply, _ := frame.(*SynReplyFrame)
-			se.Streams[reply.StreamId].ReplyToResponse(reply)
+			st, ok := se.stream(reply.StreamId)
+			if !ok {
+				se.Logger.Error("Stream#%d not exist in Session", reply.StreamId)
+				se.output.push(NewRstStreamFrame(reply.StreamId, INVALID_STREAM))
+				continue
+			}
+			if err := st.ReplyToResponse(reply); err != nil {
+				se.Logger.Error("%v", err)
+				status := PROTOCOL_ERROR
+				var rst *RstStreamError
+				if errors.As(err, &rst) {
+					status = rst.Status
+				}
+				se.removeStream(reply.StreamId)
+				se.output.push(NewRstStreamFrame(reply.StreamId, status))
+				st.Reset(err)
+				continue
+			}
+			if reply.Flags&FLAG_FIN != 0 {
+				se.removeStream(reply.StreamId)
+			}
 		case *DataFrame:
-			log.Debug("DataFrame from input queue")
+			se.Logger.Debug("DataFrame from input queue")
 			dat, _ := frame.(*DataFrame)
-			if st, ok := se.Streams[dat.StreamId]; ok {
-				log.Debug("Stream#%d exist in Session", dat.StreamId)
+			st, ok := se.stream(dat.StreamId)
+			if !se.receiveData(dat, st) {
+				continue
+			}
+			if ok {
+				se.Logger.Debug("Stream#%d exist in Session", dat.StreamId)
 				st.DataToResponse(dat)
+				if dat.Flags&FLAG_FIN != 0 {
+					se.removeStream(dat.StreamId)
+				}
 			} else {
-				log.Error("Stream#%d not exist in Session", dat.StreamId)
+				// the stream may have been reset by us already
+				se.Logger.Debug("Stream#%d not exist in Session, drop DataFrame", dat.StreamId)
 				continue
 			}
 		case *SynStreamFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame SynStreamFrame")
+			se.Logger.Debug("SynStreamFrame from input queue")
+			syn, _ := frame.(*SynStreamFrame)
+			se.push(syn)
 		case *RstStreamFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame RstStreamFrame")
+			se.Logger.Debug("RstStreamFrame from input queue")
+			rst, _ := frame.(*RstStreamFrame)
+			st, ok := se.removeStream(rst.StreamId)
+			if !ok {
+				se.Logger.Debug("Stream#%d not exist in Session, ignore %v", rst.StreamId, rst)
+				continue
+			}
+			st.Reset(&RstStreamError{StreamId: rst.StreamId, Status: rst.Status})
 		case *SettingsFrame:
-			log.Debug("SettingsFrame from input queue")
+			se.Logger.Debug("SettingsFrame from input queue")
 			set, _ := frame.(*SettingsFrame)
 			se.settings(set)
 		case *NoopFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame NoopFrame")
+			se.Logger.Debug("NoopFrame from input queue, ignore it")
 		case *PingFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame PingFrame")
+			se.Logger.Debug("PingFrame from input queue")
+			ping, _ := frame.(*PingFrame)
+			se.pong(ping)
 		case *GoawayFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame GoawayFrame")
+			se.Logger.Debug("GoawayFrame from input queue")
+			ga, _ := frame.(*GoawayFrame)
+			se.goaway(ga)
 		case *HeadersFrame:
-			log.Fatal("%v", "unimplemented NewCtrlFrame HeadersFrame")
+			se.Logger.Debug("HeadersFrame from input queue")
+			headers, _ := frame.(*HeadersFrame)
+			st, ok := se.stream(headers.StreamId)
+			if !ok {
+				se.Logger.Debug("Stream#%d not exist in Session, ignore %v", headers.StreamId, headers)
+				continue
+			}
+			if st.Response == nil {
+				se.Logger.Error("Stream#%d HeadersFrame before SynReplyFrame", headers.StreamId)
+				se.resetStream(st, PROTOCOL_ERROR)
+				continue
+			}
+			st.HeadersToResponse(headers)
+			if headers.Flags&FLAG_FIN != 0 {
+				se.removeStream(headers.StreamId)
+			}
+		case *WindowUpdateFrame:
+			se.Logger.Debug("WindowUpdateFrame from input queue")
+			wu, _ := frame.(*WindowUpdateFrame)
+			se.windowUpdate(wu)
 		default:
-			log.Error("%v", "unreachable code")
+			se.Logger.Error("%v", "unreachable code")
 		}
 	}
+
+	se.shutdown()
 }
 
 func (se *SpdySession) settings(set *SettingsFrame) {
-	se.Settings = set.Settings
+	if set.Flags&FLAG_SETTINGS_CLEAR_SETTINGS != 0 && se.SettingsStore != nil {
+		se.Logger.Debug("Clear persisted settings of %s", se.Origin)
+		if err := se.SettingsStore.Clear(se.Origin); err != nil {
+			se.Logger.Error("%v", err)
+		}
+	}
+
+	for _, s := range set.Settings {
+		se.Logger.Debug("Setting %v", s)
+		se.streamLock.Lock()
+		se.serverSettings[s.Id] = s
+		se.streamLock.Unlock()
+
+		if s.Flag&FLAG_SETTINGS_PERSIST_VALUE != 0 && se.SettingsStore != nil {
+			if err := se.SettingsStore.Set(se.Origin, s); err != nil {
+				se.Logger.Error("%v", err)
+			}
+		}
+
+		switch s.Id {
+		case SETTINGS_MAX_CONCURRENT_STREAMS:
+			se.streamLock.Lock()
+			se.maxStreams = s.Value
+			se.release()
+			se.streamLock.Unlock()
+		case SETTINGS_INITIAL_WINDOW_SIZE:
+			if se.Version >= 3 {
+				se.initialWindowSize(s.Value)
+			}
+		case SETTINGS_UPLOAD_BANDWIDTH, SETTINGS_DOWNLOAD_BANDWIDTH,
+			SETTINGS_ROUND_TRIP_TIME, SETTINGS_CURRENT_CWND,
+			SETTINGS_DOWNLOAD_RETRANS_RATE, SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE:
+			// advisory only, kept for Setting()
+		default:
+			se.Logger.Warn("Unknown %v", s)
+		}
+	}
+}
+
+// Setting returns the value of a setting the server has sent, it may be
+// called from any goroutine while the session serves.
+func (se *SpdySession) Setting(id uint32) (uint32, bool) {
+	se.streamLock.Lock()
+	defer se.streamLock.Unlock()
+
+	s, ok := se.serverSettings[id]
+	return s.Value, ok
 }
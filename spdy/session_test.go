@@ -0,0 +1,571 @@
+package spdy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServerClient returns a Client speaking spdy/3 on http:// to serve,
+// which runs the server end of each connection the client dials with framer.
+// The connection is closed once serve returns.
+func fakeServerClient(t *testing.T, serve func(framer *Framer)) *Client {
+	c := &Client{
+		Protos:         []string{"spdy/3"},
+		PriorKnowledge: true,
+		Dialer: DialFunc(func(_ context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			t.Cleanup(func() { server.Close() })
+			framer, _ := NewFramer(server, server, 3)
+			go func() {
+				defer server.Close()
+				serve(framer)
+			}()
+			return client, nil
+		}),
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// readSyn reads the frames of the client up to its next SYN_STREAM.
+func readSyn(t *testing.T, framer *Framer) *SynStreamFrame {
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if syn, ok := f.(*SynStreamFrame); ok {
+			return syn
+		}
+	}
+}
+
+// answer replies to the stream with its path and the body of its request.
+func answer(framer *Framer, streamId uint32, path string, body []byte) {
+	reply := NewSynReplyFrame(streamId)
+	reply.Header = map[string]string{":status": "200", ":version": "HTTP/1.1"}
+	framer.WriteFrame(reply)
+	framer.WriteFrame(newTestData(streamId, path+" "+string(body), FLAG_FIN))
+}
+
+// echo answers each stream of the connection once its request is complete.
+func echo(framer *Framer) {
+	paths := map[uint32]string{}
+	bodies := map[uint32][]byte{}
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *SynStreamFrame:
+			paths[f.StreamId] = f.Header[":path"]
+			if f.Flags&FLAG_FIN != 0 {
+				answer(framer, f.StreamId, paths[f.StreamId], nil)
+			}
+		case *DataFrame:
+			bodies[f.StreamId] = append(bodies[f.StreamId], f.Data.Bytes()...)
+			if f.Flags&FLAG_FIN != 0 {
+				answer(framer, f.StreamId, paths[f.StreamId], bodies[f.StreamId])
+			}
+		}
+	}
+}
+
+// sendRequest sends req on c, and returns the body of its response, or the
+// error, on result.
+func sendRequest(t *testing.T, c *Client, req *http.Request) chan string {
+	result := make(chan string, 1)
+	_, err := c.Request(req, func(_ uint32, res *http.Response, err error) {
+		if err != nil {
+			result <- "error: " + err.Error()
+			return
+		}
+		go func() {
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				result <- "error: " + err.Error()
+				return
+			}
+			result <- string(b)
+		}()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// waitResult returns what sendRequest delivers on result.
+func waitResult(t *testing.T, result chan string) string {
+	select {
+	case s := <-result:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("request not answered")
+	}
+	return ""
+}
+
+// A server may push the resources of the origin of the associated stream
+// only, a push of another origin is refused.
+func TestSessionRefusesCrossOriginPush(t *testing.T) {
+	rst := make(chan *RstStreamFrame, 1)
+	c := fakeServerClient(t, func(framer *Framer) {
+		syn := readSyn(t, framer)
+		if syn == nil {
+			return
+		}
+
+		push := func(id uint32, host string) {
+			f := NewSynStreamFrame(id)
+			f.AssociatedId = syn.StreamId
+			f.Flags = FLAG_FIN | FLAG_UNIDIRECTIONAL
+			f.Header = map[string]string{
+				":scheme": "http", ":host": host, ":path": "/style.css",
+				":status": "200", ":version": "HTTP/1.1",
+			}
+			framer.WriteFrame(f)
+		}
+		push(2, "evil.test")
+		push(4, syn.Header[":host"])
+		reply := NewSynReplyFrame(syn.StreamId)
+		reply.Flags = FLAG_FIN
+		reply.Header = map[string]string{":status": "200", ":version": "HTTP/1.1"}
+		framer.WriteFrame(reply)
+
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if r, ok := f.(*RstStreamFrame); ok {
+				rst <- r
+			}
+		}
+	})
+	pushed := make(chan string, 2)
+	c.PushHandle = func(url string, assocId uint32, res *http.Response) {
+		if res.Body != nil {
+			go io.Copy(io.Discard, res.Body)
+		}
+		pushed <- url
+	}
+
+	done := make(chan error, 1)
+	req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+	if _, err := c.Request(req, func(_ uint32, res *http.Response, err error) { done <- err }); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-rst:
+		if r.StreamId != 2 || r.Status != REFUSED_STREAM {
+			t.Errorf("%v, want REFUSED_STREAM of the cross-origin Stream#2", r)
+		}
+	case <-time.After(time.Second):
+		t.Error("cross-origin push is not reset")
+	}
+	select {
+	case url := <-pushed:
+		if url != "http://origin.test/style.css" {
+			t.Errorf("pushed %s, want the same origin push", url)
+		}
+	case <-time.After(time.Second):
+		t.Error("same origin push is not handled")
+	}
+	select {
+	case url := <-pushed:
+		t.Errorf("cross-origin push of %s is handled", url)
+	default:
+	}
+}
+
+// Late headers go to the trailer, the header the Handle has is not changed.
+func TestSessionLateHeadersToTrailer(t *testing.T) {
+	c := fakeServerClient(t, func(framer *Framer) {
+		syn := readSyn(t, framer)
+		if syn == nil {
+			return
+		}
+		reply := NewSynReplyFrame(syn.StreamId)
+		reply.Header = map[string]string{":status": "200", ":version": "HTTP/1.1", "content-type": "text/plain"}
+		framer.WriteFrame(reply)
+
+		early := NewHeadersFrame(syn.StreamId)
+		early.Header = map[string]string{"x-early": "1"}
+		framer.WriteFrame(early)
+		framer.WriteFrame(newTestData(syn.StreamId, "hello", 0))
+		late := NewHeadersFrame(syn.StreamId)
+		late.Flags = FLAG_FIN
+		late.Header = map[string]string{"x-checksum": "abc\x00def"}
+		framer.WriteFrame(late)
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+
+	type result struct {
+		res  *http.Response
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+	_, err := c.Request(req, func(_ uint32, res *http.Response, err error) {
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		header := res.Header.Clone()
+		go func() {
+			b, err := io.ReadAll(res.Body)
+			if !reflect.DeepEqual(res.Header, header) {
+				t.Errorf("header changed to %v after the handle, was %v", res.Header, header)
+			}
+			done <- result{res, string(b), err}
+		}()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	if r.err != nil || r.body != "hello" {
+		t.Fatalf("body %q, %v", r.body, r.err)
+	}
+	want := http.Header{"X-Early": {"1"}, "X-Checksum": {"abc", "def"}}
+	if !reflect.DeepEqual(r.res.Trailer, want) {
+		t.Errorf("trailer %v, want %v", r.res.Trailer, want)
+	}
+}
+
+// A second SYN_REPLY resets the stream, the Handle is called once and the
+// reader of the first response gets the error.
+func TestSessionSecondSynReply(t *testing.T) {
+	rst := make(chan *RstStreamFrame, 1)
+	c := fakeServerClient(t, func(framer *Framer) {
+		syn := readSyn(t, framer)
+		if syn == nil {
+			return
+		}
+		reply := NewSynReplyFrame(syn.StreamId)
+		reply.Header = map[string]string{":status": "200", ":version": "HTTP/1.1"}
+		framer.WriteFrame(reply)
+		framer.WriteFrame(newTestData(syn.StreamId, "hello", 0))
+		framer.WriteFrame(reply)
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if r, ok := f.(*RstStreamFrame); ok {
+				rst <- r
+			}
+		}
+	})
+
+	var handled atomic.Int32
+	bodies := make(chan io.Reader, 2)
+	req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+	_, err := c.Request(req, func(_ uint32, res *http.Response, err error) {
+		handled.Add(1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		bodies <- res.Body
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(<-bodies)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		var rstErr *RstStreamError
+		if !errors.As(err, &rstErr) || rstErr.Status != STREAM_IN_USE {
+			t.Errorf("body read %v, want STREAM_IN_USE", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("body of the first reply blocks")
+	}
+	select {
+	case r := <-rst:
+		if r.StreamId != 1 || r.Status != STREAM_IN_USE {
+			t.Errorf("%v, want STREAM_IN_USE of Stream#1", r)
+		}
+	case <-time.After(time.Second):
+		t.Error("stream not reset")
+	}
+	if n := handled.Load(); n != 1 {
+		t.Errorf("Handle called %d times", n)
+	}
+}
+
+// Pings of the server are echoed, those of the client measure the round-trip
+// time.
+func TestSessionPing(t *testing.T) {
+	echoed := make(chan uint32, 1)
+	c := fakeServerClient(t, func(framer *Framer) {
+		framer.WriteFrame(NewPingFrame(2))
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			ping, ok := f.(*PingFrame)
+			if !ok {
+				continue
+			}
+			if ping.PingId%2 == 0 {
+				echoed <- ping.PingId
+				continue
+			}
+			time.Sleep(10 * time.Millisecond)
+			framer.WriteFrame(ping)
+		}
+	})
+
+	u, _ := url.Parse("http://origin.test/")
+	rtt, err := c.Ping(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < 10*time.Millisecond || rtt > time.Second {
+		t.Errorf("round-trip time %v, want the 10ms the server waits", rtt)
+	}
+	select {
+	case id := <-echoed:
+		if id != 2 {
+			t.Errorf("echoed Ping#%d, want Ping#2", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("Ping of the server not echoed")
+	}
+}
+
+// The streams beyond the last good stream of GOAWAY are sent again on a new
+// session, but a request body which can not be read again.
+func TestSessionGoawayReplay(t *testing.T) {
+	var conns atomic.Int32
+	c := fakeServerClient(t, func(framer *Framer) {
+		if conns.Add(1) > 1 {
+			echo(framer)
+			return
+		}
+		for syns := 0; syns < 3; {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, ok := f.(*SynStreamFrame); ok {
+				syns++
+			}
+		}
+		framer.WriteFrame(NewGoawayFrame(1, 0))
+		answer(framer, 1, "first", nil)
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+
+	a, _ := http.NewRequest("GET", "http://origin.test/a", nil)
+	b, _ := http.NewRequest("POST", "http://origin.test/b", strings.NewReader("body"))
+	// a body of unknown type has no GetBody
+	cc, _ := http.NewRequest("POST", "http://origin.test/c", io.NopCloser(strings.NewReader("body")))
+	results := []chan string{sendRequest(t, c, a), sendRequest(t, c, b), sendRequest(t, c, cc)}
+
+	if got := waitResult(t, results[0]); got != "first " {
+		t.Errorf("Stream#1 got %q, want the answer of the first session", got)
+	}
+	if got := waitResult(t, results[1]); got != "/b body" {
+		t.Errorf("Stream#3 got %q, want it replayed with its body", got)
+	}
+	if got := waitResult(t, results[2]); !strings.Contains(got, "can not be replayed") {
+		t.Errorf("Stream#5 got %q, want the body can not be replayed", got)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+// Streams beyond SETTINGS_MAX_CONCURRENT_STREAMS wait in the queue, and are
+// sent in order as the streams before them finish.
+func TestSessionMaxConcurrentStreams(t *testing.T) {
+	syns := make(chan uint32, 10)
+	release := make(chan bool)
+	c := fakeServerClient(t, func(framer *Framer) {
+		framer.WriteFrame(NewSettingsFrame([]Setting{{SETTINGS_MAX_CONCURRENT_STREAMS, 0, 1}}))
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if syn, ok := f.(*SynStreamFrame); ok {
+				syns <- syn.StreamId
+				<-release
+				answer(framer, syn.StreamId, syn.Header[":path"], nil)
+			}
+		}
+	})
+	nextSyn := func() uint32 {
+		select {
+		case id := <-syns:
+			return id
+		case <-time.After(time.Second):
+			t.Fatal("no SYN_STREAM")
+		}
+		return 0
+	}
+
+	// the settings apply once the first answer is read
+	req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+	first := sendRequest(t, c, req)
+	nextSyn()
+	release <- true
+	waitResult(t, first)
+
+	var results []chan string
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+		results = append(results, sendRequest(t, c, req))
+	}
+	for _, want := range []uint32{3, 5, 7} {
+		if id := nextSyn(); id != want {
+			t.Errorf("Stream#%d sent, want Stream#%d", id, want)
+		}
+		select {
+		case id := <-syns:
+			t.Fatalf("Stream#%d sent while Stream#%d is active", id, want)
+		case <-time.After(50 * time.Millisecond):
+		}
+		release <- true
+	}
+	for _, result := range results {
+		waitResult(t, result)
+	}
+}
+
+// The settings the server asks to persist are sent first on the next session
+// to the origin, until the server clears them.
+func TestSessionPersistedSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	store, err := NewSettingsStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxStreams := Setting{SETTINGS_MAX_CONCURRENT_STREAMS, FLAG_SETTINGS_PERSIST_VALUE, 100}
+	rtt := Setting{SETTINGS_ROUND_TRIP_TIME, 0, 30}
+
+	sent := make(chan Frame, 1)
+	var conns atomic.Int32
+	c := fakeServerClient(t, func(framer *Framer) {
+		if conns.Add(1) == 1 {
+			framer.WriteFrame(NewSettingsFrame([]Setting{maxStreams, rtt}))
+		} else {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			sent <- f
+			clear := NewSettingsFrame(nil)
+			clear.Flags = FLAG_SETTINGS_CLEAR_SETTINGS
+			framer.WriteFrame(clear)
+		}
+		echo(framer)
+	})
+	c.SettingsStore = store
+
+	persisted := func() []Setting {
+		store, err := NewSettingsStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store.Get("origin.test:80")
+	}
+
+	req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+	waitResult(t, sendRequest(t, c, req))
+	want := []Setting{{SETTINGS_MAX_CONCURRENT_STREAMS, FLAG_SETTINGS_PERSISTED, 100}}
+	if got := persisted(); !reflect.DeepEqual(got, want) {
+		t.Errorf("persisted %v, want %v", got, want)
+	}
+
+	c.Close()
+	waitResult(t, sendRequest(t, c, req))
+	set, ok := (<-sent).(*SettingsFrame)
+	if !ok || !reflect.DeepEqual(set.Settings, want) {
+		t.Errorf("new session sent %v first, want SETTINGS %v", set, want)
+	}
+	if got := store.Get("origin.test:80"); len(got) != 0 {
+		t.Errorf("store keeps %v after CLEAR_SETTINGS", got)
+	}
+	if got := persisted(); len(got) != 0 {
+		t.Errorf("file keeps %v after CLEAR_SETTINGS", got)
+	}
+}
+
+// The streams and pings of a session whose connection dies get
+// ErrSessionClosed.
+func TestSessionClosedByServer(t *testing.T) {
+	c := fakeServerClient(t, func(framer *Framer) {
+		var syns, pings int
+		for syns < 2 || pings < 1 {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch f := f.(type) {
+			case *SynStreamFrame:
+				syns++
+				if syns == 1 {
+					// a response whose body is being read
+					reply := NewSynReplyFrame(f.StreamId)
+					reply.Header = map[string]string{":status": "200", ":version": "HTTP/1.1"}
+					framer.WriteFrame(reply)
+				}
+			case *PingFrame:
+				pings++
+			}
+		}
+	})
+
+	req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+	reading := sendRequest(t, c, req)
+	waiting := sendRequest(t, c, req)
+	u, _ := url.Parse("http://origin.test/")
+	if _, err := c.Ping(u); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("Ping: err = %v, want ErrSessionClosed", err)
+	}
+	for what, result := range map[string]chan string{"reading its body": reading, "waiting for its reply": waiting} {
+		// wrapping the error of the connection
+		if got := waitResult(t, result); !strings.HasPrefix(got, "error: "+ErrSessionClosed.Error()) {
+			t.Errorf("stream %s got %q, want ErrSessionClosed", what, got)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package spdy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// SettingsStore keeps the settings servers ask to persist, by origin, and
+// writes them to a file when it has a path.
+type SettingsStore struct {
+	path     string
+	lock     sync.Mutex
+	settings map[string]map[uint32]Setting
+}
+
+// NewSettingsStore loads the settings persisted in path, an empty path keeps
+// them in memory only.
+func NewSettingsStore(path string) (*SettingsStore, error) {
+	store := &SettingsStore{
+		path:     path,
+		settings: map[string]map[uint32]Setting{},
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	saved := map[string][]Setting{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for origin, settings := range saved {
+		store.settings[origin] = map[uint32]Setting{}
+		for _, s := range settings {
+			store.settings[origin][s.Id] = s
+		}
+	}
+
+	return store, nil
+}
+
+// Get returns the settings persisted for origin, flagged to be sent back.
+func (store *SettingsStore) Get(origin string) []Setting {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	settings := make([]Setting, 0, len(store.settings[origin]))
+	for _, s := range store.settings[origin] {
+		s.Flag = FLAG_SETTINGS_PERSISTED
+		settings = append(settings, s)
+	}
+	return settings
+}
+
+// Set persists s for origin, the error is of writing the file.
+func (store *SettingsStore) Set(origin string, s Setting) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.settings[origin] == nil {
+		store.settings[origin] = map[uint32]Setting{}
+	}
+	store.settings[origin][s.Id] = s
+
+	return store.save()
+}
+
+// Clear forgets the settings of origin, the error is of writing the file.
+func (store *SettingsStore) Clear(origin string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.settings, origin)
+
+	return store.save()
+}
+
+// save writes the store to its file, the caller holds the lock.
+func (store *SettingsStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	saved := map[string][]Setting{}
+	for origin, settings := range store.settings {
+		for _, s := range settings {
+			saved[origin] = append(saved[origin], s)
+		}
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.path)
+}
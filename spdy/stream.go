@@ -3,76 +3,219 @@ package spdy
 import (
 	"bytes"
 //	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// connectionHeaders are HTTP/1.1 connection specific, and not allowed in spdy
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+}
+
 type Stream struct {
 	StreamId uint32
 	Request  *http.Request
 	Response *http.Response
 	InFrames []*DataFrame
 	handle   Handle
-	resw     *io.PipeWriter
-	resr     io.Reader
+	body     *streamBody
+	version  uint16
+	session  *SpdySession
+	logger   *Logger
+	started  bool // SYN_STREAM is sent, false while waiting in queue
+	priority uint8
+
+	// flow control of spdy/3, the windows are nil for spdy/2
+	sendWindow *window
+	recvWindow *recvWindow
+
+	// lock guards Response, body and reset, a stream is reset from other
+	// goroutines while proc builds its response
+	lock  sync.Mutex
+	reset bool
+
+	// timer cancels the stream when a response timeout expires, stopCtx
+	// stops watching the request's context
+	timer   *time.Timer
+	stopCtx func() bool
+}
+
+// RstStreamError is delivered to a stream's Handle, or to its response body,
+// when the stream is reset by either endpoint.
+type RstStreamError struct {
+	StreamId uint32
+	Status   uint32
+}
+
+func (e *RstStreamError) Error() string {
+	return fmt.Sprintf("Stream#%d reset with %s", e.StreamId, StatusName(e.Status))
 }
 
 func NewStream(streamId uint32) *Stream {
 	st := &Stream{
 		StreamId: streamId,
 		InFrames: make([]*DataFrame, 0, 2),
+		logger:   log,
 	}
 
 	return st
 }
 
-func (st *Stream) Syn(output chan Frame, req *http.Request, writer io.Writer,
-		      zbuf *bytes.Buffer, zwriter io.Writer) {
+func (st *Stream) Syn(output *scheduler, req *http.Request) {
 	st.Request = req
 
 	syn := st.headerToFrame(req)
 
-	if req.Body != nil {
-		log.Trace("Stream#%d Request with body", st.StreamId)
-		output <- syn
-		dat := st.bodyToFrame(req.Body)
-		dat.Flags = FLAG_FIN
-		output <- dat
-	} else {
-		log.Trace("Stream#%d Request without body", st.StreamId)
+	if req.Body == nil {
+		st.logger.Trace("Stream#%d Request without body", st.StreamId)
 		syn.Flags = FLAG_FIN
-		output <- syn
+		output.push(syn)
+		return
 	}
+
+	// SYN_STREAM is queued at once to keep stream ids in order, the body
+	// may wait for the send window
+	st.logger.Trace("Stream#%d Request with body", st.StreamId)
+	output.push(syn)
+	go st.sendBody(output, req)
 }
 
-func (st *Stream) bodyToFrame(body io.ReadCloser) *DataFrame {
-	frame := NewDataFrame(st.StreamId)
+// sendBody reads the request body as it comes, so bodies of unknown length
+// are streamed, and sends it in DataFrames of at most the session's
+// MaxDataFrameSize. A chunk is held until the next read, so FLAG_FIN is set
+// on the last DataFrame.
+func (st *Stream) sendBody(output *scheduler, req *http.Request) {
+	defer req.Body.Close()
 
-	buf := bytes.NewBuffer(make([]byte, 0))
+	size := DEFAULT_DATA_FRAME_SIZE
+	if st.session != nil && st.session.MaxDataFrameSize > 0 {
+		size = st.session.MaxDataFrameSize
+	}
+	if size > MAX_DATA_LENGTH {
+		size = MAX_DATA_LENGTH
+	}
+	trailer := len(req.Trailer) > 0
 
-	bs, _ := ioutil.ReadAll(body)
-	buf.Write(bs)
+	var chunk []byte
+	for {
+		buf := make([]byte, size)
+		n, err := req.Body.Read(buf)
+		if n > 0 {
+			if chunk != nil && !st.sendData(output, chunk, false) {
+				return
+			}
+			chunk = buf[:n]
+		}
 
-	frame.Length = uint32(buf.Len())
-	frame.Data = buf
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			st.logger.Error("Stream#%d read request body: %v", st.StreamId, err)
+			st.abort(output, err)
+			return
+		}
+	}
 
-	return frame
+	if chunk == nil {
+		chunk = []byte{}
+	}
+	if !st.sendData(output, chunk, !trailer) || !trailer {
+		return
+	}
+
+	st.logger.Trace("Stream#%d Request with trailer", st.StreamId)
+	frame := NewHeadersFrame(st.StreamId)
+	for k, vs := range req.Trailer {
+		frame.Header[strings.ToLower(k)] = strings.Join(vs, "\x00")
+	}
+	frame.Flags = FLAG_FIN
+	output.push(frame)
+}
+
+// abort resets the stream with CANCEL when its request can not be sent, and
+// delivers err to the stream.
+func (st *Stream) abort(output *scheduler, err error) {
+	if st.session != nil {
+		st.session.removeStream(st.StreamId)
+	}
+	output.push(NewRstStreamFrame(st.StreamId, CANCEL))
+	st.Reset(err)
+}
+
+// sendData splits data into DataFrames no larger than the send windows
+// allow, and waits for WINDOW_UPDATE when they are used up. It returns false
+// if the stream is closed before all data is sent.
+func (st *Stream) sendData(output *scheduler, data []byte, fin bool) bool {
+	for {
+		n := int64(len(data))
+		if st.sendWindow != nil && n > 0 {
+			if n = takeWindows(st.sendWindow, st.session.sendWindow, n); n == 0 {
+				st.logger.Debug("Stream#%d closed while waiting for window", st.StreamId)
+				return false
+			}
+		}
+
+		frame := NewDataFrame(st.StreamId)
+		frame.Data = bytes.NewBuffer(data[:n])
+		frame.Length = uint32(n)
+		data = data[n:]
+		if fin && len(data) == 0 {
+			frame.Flags = FLAG_FIN
+		}
+		if !output.push(frame) {
+			st.logger.Debug("Stream#%d closed while sending data", st.StreamId)
+			return false
+		}
+
+		if len(data) == 0 {
+			return true
+		}
+	}
 }
 
 func (st *Stream) headerToFrame(req *http.Request) *SynStreamFrame {
 	frame := NewSynStreamFrame(st.StreamId)
+	frame.Version = st.version
+	frame.Priority = uint16(st.priority)
 
 	for k, vs := range req.Header {
-		frame.Header[strings.ToLower(k)] = strings.Join(vs, "\x00")
+		k = strings.ToLower(k)
+		if connectionHeaders[k] {
+			continue
+		}
+		frame.Header[k] = strings.Join(vs, "\x00")
 	}
 
-	frame.Header["version"] = req.Proto
-	frame.Header["method"] = req.Method
-	frame.Header["scheme"] = req.URL.Scheme
-	frame.Header["host"] = req.Host
+	// spdy/3 prefixes the request line and host with a colon
+	prefix := ""
+	if st.version >= 3 {
+		prefix = ":"
+		delete(frame.Header, "host")
+	}
+
+	// requests made by http.Client for redirects leave them empty
+	proto, method := req.Proto, req.Method
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	if method == "" {
+		method = "GET"
+	}
+	frame.Header[prefix+"version"] = proto
+	frame.Header[prefix+"method"] = method
+	frame.Header[prefix+"scheme"] = req.URL.Scheme
+	frame.Header[prefix+"host"] = req.Host
 
 	url := req.URL.Path
 	if url == "" {
@@ -84,52 +227,229 @@ func (st *Stream) headerToFrame(req *http.Request) *SynStreamFrame {
 	if req.URL.Fragment != "" {
 		url += "#" + req.URL.Fragment
 	}
-	frame.Header["url"] = url
+	if st.version >= 3 {
+		frame.Header[":path"] = url
+	} else {
+		frame.Header["url"] = url
+	}
 
 	return frame
 }
 
-func (st *Stream) ReplyToResponse(srf *SynReplyFrame) {
-	header := http.Header{}
+// ReplyToResponse builds the response of the stream, and passes it to the
+// Handle unless the stream has been reset. A second SYN_REPLY returns the
+// *RstStreamError the stream is to be reset with.
+func (st *Stream) ReplyToResponse(srf *SynReplyFrame) error {
+	st.logger.Trace("SynReplyFrame header: %v", srf.Header)
 
-	log.Trace("SynReplyFrame header: %v", srf.Header)
-	for k, v := range srf.Header {
-		vs := strings.Split(v, "\x00")
-		for _, s := range vs {
-			header.Add(k, s)
+	st.lock.Lock()
+	if st.reset {
+		st.lock.Unlock()
+		return nil
+	}
+	if st.Response != nil {
+		// the Handle has the response of the first SYN_REPLY already
+		st.lock.Unlock()
+		st.logger.Error("Stream#%d SynReplyFrame twice", st.StreamId)
+		status := PROTOCOL_ERROR
+		if st.version >= 3 {
+			status = STREAM_IN_USE
 		}
+		return &RstStreamError{StreamId: st.StreamId, Status: status}
+	}
+	err := st.headerToResponse(srf.Header, srf.Flags)
+	st.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if st.body != nil && st.session != nil {
+		st.watch(st.session.BodyIdleTimeout, ErrBodyIdleTimeout)
+	} else {
+		st.watch(0, nil)
+	}
+
+	st.handle(st.StreamId, st.Response, nil)
+	return nil
+}
+
+// SynToResponse builds the response of a stream pushed by the server.
+func (st *Stream) SynToResponse(syn *SynStreamFrame) error {
+	st.logger.Trace("SynStreamFrame header: %v", syn.Header)
+	return st.headerToResponse(syn.Header, syn.Flags)
+}
+
+func (st *Stream) headerToResponse(frameHeader map[string]string, flags uint8) error {
+	header := http.Header{}
+	mergeHeader(header, frameHeader)
+	st.logger.Trace("Response header: %v", header)
+
+	status, version := frameHeader["status"], frameHeader["version"]
+	if st.version >= 3 {
+		status, version = frameHeader[":status"], frameHeader[":version"]
+	}
+	if len(status) < 3 || version == "" {
+		return fmt.Errorf("Stream#%d response without status or version", st.StreamId)
 	}
-	log.Trace("Response header: %v", header)
 
 	st.Response = &http.Response{
 		Header:  header,
+		Trailer: http.Header{},
 		Request: st.Request,
 	}
-	st.Response.Status = header["Status"][0]
+	st.Response.Status = status
 	statusCode, _ := strconv.Atoi(st.Response.Status[:3])
 	st.Response.StatusCode = statusCode
 
-	st.Response.Proto = header["Version"][0]
+	st.Response.Proto = version
+	st.Response.ProtoMajor, st.Response.ProtoMinor, _ = http.ParseHTTPVersion(version)
 
 	transencoding := header["Content-Encoding"]
 	st.Response.TransferEncoding = transencoding
 
-	log.Debug("Stream#%d SynReplyFrame flag %d", st.StreamId, srf.Flags)
-	if srf.Flags != FLAG_FIN {
-		st.resr, st.resw = io.Pipe()
+	st.logger.Debug("Stream#%d response flag %d", st.StreamId, flags)
+	if flags&FLAG_FIN == 0 {
+		st.body = newStreamBody(st.consumed)
 
-		st.Response.Body = ioutil.NopCloser(st.resr)
+		st.Response.Body = &responseBody{st}
 	}
 
-	st.handle(st.StreamId, st.Response, nil)
+	return nil
+}
+
+// HeadersToResponse merges late headers into the response trailer. The
+// Handle may be reading the response already, so the header is left alone,
+// and as in net/http the trailer is complete once the body returns io.EOF.
+func (st *Stream) HeadersToResponse(hf *HeadersFrame) {
+	mergeHeader(st.Response.Trailer, hf.Header)
+	st.logger.Trace("Stream#%d HeadersFrame merged: %v", st.StreamId, hf.Header)
+
+	if hf.Flags&FLAG_FIN != 0 && st.body != nil {
+		st.body.Close()
+	}
+}
+
+func mergeHeader(header http.Header, frameHeader map[string]string) {
+	for k, v := range frameHeader {
+		if strings.HasPrefix(k, ":") {
+			// spdy/3 pseudo headers are not http headers
+			continue
+		}
+		vs := strings.Split(v, "\x00")
+		for _, s := range vs {
+			header.Add(k, s)
+		}
+	}
 }
 
 func (st *Stream) DataToResponse(dat *DataFrame) {
-	log.Debug("StreamId#%d data to write...", st.StreamId)
-	dat.Data.WriteTo(st.resw)
+	st.logger.Debug("StreamId#%d data to write...", st.StreamId)
+	if dat.Flags&FLAG_FIN == 0 && st.session != nil {
+		st.watch(st.session.BodyIdleTimeout, ErrBodyIdleTimeout)
+	}
+	if st.body == nil {
+		st.logger.Error("Stream#%d DataFrame without response body", st.StreamId)
+		return
+	}
+	dat.Data.WriteTo(st.body)
+
+	if dat.Flags&FLAG_FIN != 0 {
+		st.body.Close()
+	}
+}
+
+// Reset delivers err to the stream: to its Handle if no reply has been seen
+// yet, otherwise to the reader of the response body. Only the first reset is
+// delivered.
+func (st *Stream) Reset(err error) {
+	st.lock.Lock()
+	if st.reset {
+		st.lock.Unlock()
+		return
+	}
+	st.reset = true
+	res, body := st.Response, st.body
+	st.lock.Unlock()
+
+	st.logger.Debug("Stream#%d reset: %v", st.StreamId, err)
+
+	if st.sendWindow != nil {
+		st.sendWindow.close()
+	}
+
+	if res == nil {
+		st.handle(st.StreamId, nil, err)
+	} else if body != nil {
+		body.CloseWithError(err)
+	}
+}
+
+// watch cancels the stream with err unless it is watched again, or leaves the
+// session, within d. 0 stops watching.
+func (st *Stream) watch(d time.Duration, err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	if d <= 0 || st.reset || st.session == nil {
+		return
+	}
+	se := st.session
+	st.timer = time.AfterFunc(d, func() {
+		se.cancel(st, err)
+	})
+}
+
+// watchContext cancels the stream with ctx's error when ctx is done.
+func (st *Stream) watchContext(ctx context.Context) {
+	if ctx.Done() == nil || st.session == nil {
+		return
+	}
+	se := st.session
+	stop := context.AfterFunc(ctx, func() {
+		se.cancel(st, ctx.Err())
+	})
+
+	st.lock.Lock()
+	st.stopCtx = stop
+	st.lock.Unlock()
+}
+
+// unwatch stops the timeouts and the context of a stream leaving the
+// session.
+func (st *Stream) unwatch() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	if st.stopCtx != nil {
+		st.stopCtx()
+		st.stopCtx = nil
+	}
+}
+
+// responseBody is the Body of a stream's response, closing it before EOF
+// resets the stream with CANCEL.
+type responseBody struct {
+	st *Stream
+}
+
+func (rb *responseBody) Read(p []byte) (int, error) {
+	return rb.st.body.Read(p)
+}
 
-	if dat.Flags == FLAG_FIN {
-		st.resw.Close()
+func (rb *responseBody) Close() error {
+	if rb.st.session != nil {
+		// the stream is not in session any more once it is finished
+		rb.st.session.CancelStream(rb.st.StreamId)
 	}
+	rb.st.body.CloseWithError(errors.New("Read on closed response body"))
+	return nil
 }
 
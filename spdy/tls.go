@@ -0,0 +1,83 @@
+package spdy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// PIN_PREFIX starts the SPKI pins of SPKIPin, as curl --pinnedpubkey
+// writes them.
+const PIN_PREFIX = "sha256//"
+
+// LoadTLSConfig returns a TLS config trusting the PEM certificates of caFile,
+// or the system roots when it is empty, and presenting the client
+// certificate of certFile and keyFile when they are set.
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate in CA file " + caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// SPKIPin returns the pin of cert's public key, the base64 SHA-256 of its
+// SubjectPublicKeyInfo prefixed with PIN_PREFIX.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// checkPins succeeds when a certificate the handshake vouches for has one of
+// pins: one of the verified chains, or the leaf alone when verification is
+// skipped, as a peer may send any other certificate along. Pins may leave out
+// PIN_PREFIX.
+func checkPins(state tls.ConnectionState, insecure bool, pins []string) error {
+	chains := state.VerifiedChains
+	if insecure {
+		chains = nil
+		if len(state.PeerCertificates) > 0 {
+			chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+		}
+	}
+
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := SPKIPin(cert)
+			for _, p := range pins {
+				if !strings.HasPrefix(p, PIN_PREFIX) {
+					p = PIN_PREFIX + p
+				}
+				if p == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("Certificate chain matches no pinned public key")
+}
@@ -0,0 +1,135 @@
+package spdy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate of name signed by parent, or self signed when
+// parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, name string, ca bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if !ca {
+		template.DNSNames = []string{name}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// pinClient returns a client whose connections reach a TLS server presenting
+// chain, with the key of its first certificate.
+func pinClient(chain []*testCert, config *tls.Config, pins []string) *Client {
+	served := tls.Certificate{PrivateKey: chain[0].key, Leaf: chain[0].cert}
+	for _, c := range chain {
+		served.Certificate = append(served.Certificate, c.cert.Raw)
+	}
+	dial := func(_ context.Context, network, addr string) (net.Conn, error) {
+		c, s := net.Pipe()
+		go func() {
+			conn := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{served}})
+			if conn.Handshake() == nil {
+				io.Copy(io.Discard, conn)
+			}
+			conn.Close()
+		}()
+		return c, nil
+	}
+	return &Client{TLSConfig: config, Pins: pins, Dialer: DialFunc(dial)}
+}
+
+func TestPinsMatchVerifiedChain(t *testing.T) {
+	ca := newTestCert(t, "Test CA", true, nil)
+	leaf := newTestCert(t, "victim.test", false, ca)
+	other := newTestCert(t, "Other CA", true, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, tt := range []struct {
+		name string
+		pins []string
+		ok   bool
+	}{
+		{"leaf", []string{SPKIPin(leaf.cert)}, true},
+		{"ca", []string{SPKIPin(ca.cert)}, true},
+		{"without prefix", []string{SPKIPin(ca.cert)[len(PIN_PREFIX):]}, true},
+		{"other", []string{SPKIPin(other.cert)}, false},
+	} {
+		c := pinClient([]*testCert{leaf, ca}, &tls.Config{RootCAs: roots}, tt.pins)
+		conn, _, err := c.dialTLS(context.Background(), "victim.test:443")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// A server appending the pinned certificate to its own chain must not pass.
+func TestPinsIgnoreUnverifiedCertificates(t *testing.T) {
+	ca := newTestCert(t, "Test CA", true, nil)
+	victim := newTestCert(t, "victim.test", false, ca)
+	evil := newTestCert(t, "victim.test", false, ca)
+	selfSigned := newTestCert(t, "victim.test", false, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	pins := []string{SPKIPin(victim.cert)}
+
+	c := pinClient([]*testCert{selfSigned, victim}, &tls.Config{InsecureSkipVerify: true}, pins)
+	if conn, _, err := c.dialTLS(context.Background(), "victim.test:443"); err == nil {
+		conn.Close()
+		t.Error("insecure: a pinned certificate sent after the leaf passed")
+	}
+
+	c = pinClient([]*testCert{evil, ca, victim}, &tls.Config{RootCAs: roots}, pins)
+	if conn, _, err := c.dialTLS(context.Background(), "victim.test:443"); err == nil {
+		conn.Close()
+		t.Error("verified: a pinned certificate outside the verified chain passed")
+	}
+
+	c = pinClient([]*testCert{victim, ca}, &tls.Config{InsecureSkipVerify: true}, pins)
+	conn, _, err := c.dialTLS(context.Background(), "victim.test:443")
+	if err != nil {
+		t.Fatalf("insecure: the pinned leaf failed: %v", err)
+	}
+	conn.Close()
+}
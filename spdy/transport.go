@@ -0,0 +1,101 @@
+package spdy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Transport is an http.RoundTripper sending requests on the sessions of a
+// Client, spdy or HTTP/1.1 as negotiated with each origin, so redirects,
+// cookie jars and timeouts of http.Client apply:
+//
+//	client := &http.Client{Transport: &spdy.Transport{}}
+type Transport struct {
+	// Client sends the requests, DefaultClient when nil.
+	Client *Client
+
+	// Priority of the streams, 0 is the highest.
+	Priority uint8
+}
+
+type roundTripResult struct {
+	res *http.Response
+	err error
+}
+
+// RoundTrip sends req and waits for the response headers, the body of the
+// response streams from the stream. Canceling the request's context resets
+// the stream.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		closeBody(req)
+		return nil, errors.New("Request without url")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		closeBody(req)
+		return nil, errors.New("Unsupported scheme: " + req.URL.Scheme)
+	}
+
+	out := req
+	if req.Host == "" || req.Body == http.NoBody {
+		r := *req
+		if r.Host == "" {
+			r.Host = req.URL.Host
+		}
+		if r.Body == http.NoBody {
+			r.Body = nil
+		}
+		out = &r
+	}
+
+	client := t.Client
+	if client == nil {
+		client = DefaultClient
+	}
+
+	result := make(chan roundTripResult, 1)
+	id, err := client.RequestWithPriority(out, t.Priority, func(streamId uint32, res *http.Response, err error) {
+		result <- roundTripResult{res, err}
+	})
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	select {
+	case rr := <-result:
+		if rr.err != nil {
+			return nil, rr.err
+		}
+		return t.response(req, rr.res), nil
+	case <-req.Context().Done():
+		// the stream, or the one replaying it after GOAWAY, watches the
+		// context of out and is reset by it
+		client.logger().Debug("Stream#%d request canceled", id)
+		return nil, req.Context().Err()
+	}
+}
+
+// response completes res as http.Client expects it, responses of HTTP/1.1
+// sessions are complete but for the request.
+func (t *Transport) response(req *http.Request, res *http.Response) *http.Response {
+	res.Request = req
+	if res.Body == nil {
+		res.Body = http.NoBody
+		res.ContentLength = 0
+	} else if res.Body == http.NoBody || res.ContentLength != 0 {
+		// read by HTTP/1.1
+	} else if n, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64); err == nil {
+		res.ContentLength = n
+	} else {
+		res.ContentLength = -1
+	}
+	return res
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -4,37 +4,43 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
-func (f *SynStreamFrame) write(w io.Writer, buf *bytes.Buffer, zw *zlib.Writer) {
-
-	zheader := writeHeader(f.Header, buf, zw)
+func (f *SynStreamFrame) write(w io.Writer, buf *bytes.Buffer, zw *zlib.Writer) error {
+	zheader, err := writeHeader(f.Header, f.Version, buf, zw)
+	if err != nil {
+		return err
+	}
 
 	blen := len(zheader) + 18
-	log.Trace("New Buffer with bytes size = %d", blen)
 	bs := make([]byte, 0, blen)
 	b := bytes.NewBuffer(bs)
 
-	b.Write([]byte{0x80, 0x02, 0x00, 0x01})
+	b.Write(uint16ToBytes(0x8000 | f.Version))
+	b.Write(uint16ToBytes(SYN_STREAM))
 
+	if len(zheader)+10 > MAX_DATA_LENGTH {
+		return errors.New("SynStreamFrame header is too large")
+	}
 	flagsLength := (uint32(f.Flags)<<24) + uint32(len(zheader)) + 10
 	b.Write(uint32ToBytes(flagsLength))
 	b.Write(uint32ToBytes(f.StreamId))
 	b.Write(uint32ToBytes(f.AssociatedId))
 
-	priority := f.Priority << 14
+	var priority uint16
+	if f.Version >= 3 {
+		priority = f.Priority<<13 | uint16(f.Slot)
+	} else {
+		priority = f.Priority << 14
+	}
 	b.Write(uint16ToBytes(priority))
 
 	b.Write(zheader)
 
-	if log.TraceEnabled() {
-		log.Trace("zlib header: %x", zheader)
-		log.Trace("Write to Session: (%d)%x", b.Len(), b.Bytes())
-	}
-	b.WriteTo(w)
-
-	log.Debug("Send frame: %v", f)
+	return writeFrame(w, b)
 }
 
 func uint32ToBytes(u uint32) []byte {
@@ -56,36 +62,178 @@ func uint16ToBytes(u uint16) []byte {
 	return bs
 }
 
-func writeHeader(header map[string]string, buf *bytes.Buffer, zw *zlib.Writer) []byte {
-	defer buf.Reset()
+// writeFrame writes the encoded frame b to w.
+func writeFrame(w io.Writer, b *bytes.Buffer) error {
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// writeHeader compresses a name/value header block with the session's shared
+// zlib writer, the block is valid until the next call.
+func writeHeader(header map[string]string, version uint16, buf *bytes.Buffer, zw *zlib.Writer) ([]byte, error) {
+	buf.Reset()
+
+	writeLen := func(n int) {
+		if version >= 3 {
+			binary.Write(zw, binary.BigEndian, uint32(n))
+		} else {
+			binary.Write(zw, binary.BigEndian, uint16(n))
+		}
+	}
 
-	binary.Write(zw, binary.BigEndian, uint16(len(header)))
+	writeLen(len(header))
 
 	for k, v := range header {
-		binary.Write(zw, binary.BigEndian, uint16(len(k)))
+		writeLen(len(k))
 		io.WriteString(zw, k)
-		binary.Write(zw, binary.BigEndian, uint16(len(v)))
+		writeLen(len(v))
 		io.WriteString(zw, v)
 	}
-	zw.Flush()
+	if err := zw.Flush(); err != nil {
+		return nil, err
+	}
 
-	return buf.Bytes()
+	return buf.Bytes(), nil
 }
 
-func (f *DataFrame) write(w io.Writer) {
+func (f *DataFrame) write(w io.Writer) error {
+	length := 0
+	if f.Data != nil {
+		length = f.Data.Len()
+	}
+	if uint32(length) != f.Length {
+		return fmt.Errorf("DataFrame Length %d mismatch data length %d", f.Length, length)
+	}
+	if length > MAX_DATA_LENGTH {
+		return fmt.Errorf("DataFrame Length %d is too large", length)
+	}
+
 	blen := f.Length + 8
-	log.Trace("New Buffer with bytes size = %d", blen)
-	bs := make([]byte, blen)
-	b := bytes.NewBuffer(bs)
-	b.Reset()
+	b := bytes.NewBuffer(make([]byte, 0, blen))
+
+	b.Write(uint32ToBytes(f.StreamId & 0x7fffffff))
+	b.Write(uint32ToBytes(uint32(f.Flags)<<24 + f.Length))
+	if f.Data != nil {
+		f.Data.WriteTo(b)
+	}
 
-	binary.Write(b, binary.BigEndian, uint32ToBytes(f.StreamId))
-	flagsLength := (uint32(f.Flags) << 24) + uint32(f.Length)
-	binary.Write(b, binary.BigEndian, uint32ToBytes(flagsLength))
+	return writeFrame(w, b)
+}
 
-	f.Data.WriteTo(b)
+func (f *RstStreamFrame) write(w io.Writer) error {
+	b := bytes.NewBuffer(make([]byte, 0, 16))
 
-	b.WriteTo(w)
+	b.Write(uint16ToBytes(0x8000 | f.Version))
+	b.Write(uint16ToBytes(RST_STREAM))
+	b.Write(uint32ToBytes(uint32(f.Flags)<<24 + 8))
+	b.Write(uint32ToBytes(f.StreamId))
+	b.Write(uint32ToBytes(f.Status))
+
+	return writeFrame(w, b)
+}
+
+func (f *PingFrame) write(w io.Writer) error {
+	b := bytes.NewBuffer(make([]byte, 0, 12))
+
+	b.Write(uint16ToBytes(0x8000 | f.Version))
+	b.Write(uint16ToBytes(PING))
+	b.Write(uint32ToBytes(uint32(f.Flags)<<24 + 4))
+	b.Write(uint32ToBytes(f.PingId))
+
+	return writeFrame(w, b)
+}
+
+func (f *SynReplyFrame) write(w io.Writer, buf *bytes.Buffer, zw *zlib.Writer) error {
+	return writeStreamHeader(w, buf, zw, f, SYN_REPLY, f.StreamId, f.Header)
+}
+
+func (f *HeadersFrame) write(w io.Writer, buf *bytes.Buffer, zw *zlib.Writer) error {
+	return writeStreamHeader(w, buf, zw, f, HEADERS, f.StreamId, f.Header)
+}
+
+// writeStreamHeader writes SYN_REPLY and HEADERS, which differ only in type.
+func writeStreamHeader(w io.Writer, buf *bytes.Buffer, zw *zlib.Writer, f ctrlFrame,
+	typ uint16, streamId uint32, header map[string]string) error {
+	head := f.ctrlHead()
+	zheader, err := writeHeader(header, head.Version, buf, zw)
+	if err != nil {
+		return err
+	}
+
+	length := uint32(len(zheader)) + streamHeadLength(head.Version)
+	if length > MAX_DATA_LENGTH {
+		return fmt.Errorf("CtrlFrame Type %d header is too large", typ)
+	}
+	b := bytes.NewBuffer(make([]byte, 0, length+8))
+
+	b.Write(uint16ToBytes(0x8000 | head.Version))
+	b.Write(uint16ToBytes(typ))
+	b.Write(uint32ToBytes(uint32(head.Flags)<<24 + length))
+	b.Write(uint32ToBytes(streamId & 0x7fffffff))
+	if head.Version < 3 {
+		b.Write(uint16ToBytes(0))
+	}
+	b.Write(zheader)
+
+	return writeFrame(w, b)
+}
+
+func (f *NoopFrame) write(w io.Writer) error {
+	b := bytes.NewBuffer(make([]byte, 0, 8))
+
+	b.Write(uint16ToBytes(0x8000 | f.Version))
+	b.Write(uint16ToBytes(NOOP))
+	b.Write(uint32ToBytes(0))
+
+	return writeFrame(w, b)
+}
+
+func (f *GoawayFrame) write(w io.Writer) error {
+	length := goawayLength(f.Version)
+	b := bytes.NewBuffer(make([]byte, 0, length+8))
+
+	b.Write(uint16ToBytes(0x8000 | f.Version))
+	b.Write(uint16ToBytes(GOAWAY))
+	b.Write(uint32ToBytes(uint32(f.Flags)<<24 + length))
+	b.Write(uint32ToBytes(f.LastGoodId & 0x7fffffff))
+	if f.Version >= 3 {
+		b.Write(uint32ToBytes(f.Status))
+	}
+
+	return writeFrame(w, b)
+}
+
+func (f *WindowUpdateFrame) write(w io.Writer) error {
+	b := bytes.NewBuffer(make([]byte, 0, 16))
+
+	b.Write(uint16ToBytes(0x8000 | f.Version))
+	b.Write(uint16ToBytes(WINDOW_UPDATE))
+	b.Write(uint32ToBytes(uint32(f.Flags)<<24 + 8))
+	b.Write(uint32ToBytes(f.StreamId))
+	b.Write(uint32ToBytes(f.DeltaWindowSize))
+
+	return writeFrame(w, b)
+}
+
+func (f *SettingsFrame) write(w io.Writer) error {
+	length := uint32(4 + 8*len(f.Settings))
+	b := bytes.NewBuffer(make([]byte, 0, length+8))
+
+	b.Write(uint16ToBytes(0x8000 | f.Version))
+	b.Write(uint16ToBytes(SETTINGS))
+	b.Write(uint32ToBytes(uint32(f.Flags)<<24 + length))
+	b.Write(uint32ToBytes(uint32(len(f.Settings))))
+
+	for _, s := range f.Settings {
+		idFlag := uint32(s.Flag)<<24 | s.Id&0x00ffffff
+		if f.Version >= 3 {
+			binary.Write(b, binary.BigEndian, idFlag)
+		} else {
+			// spdy/2 sends the id in little endian, as it reads
+			binary.Write(b, binary.LittleEndian, idFlag)
+		}
+		b.Write(uint32ToBytes(s.Value))
+	}
 
-	log.Debug("Send DataFrame: %v", f)
+	return writeFrame(w, b)
 }